@@ -0,0 +1,275 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Kieren Hynd (kieren@ticketmaster.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package influx
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"strconv"
+	"strings"
+)
+
+// Decoder that expects InfluxDB line protocol in the message payload (ie;
+// from Telegraf), of the form:
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//
+// Each numeric field becomes a separate message, with the metric name
+// "measurement.field" in Fields[Metric], the value in Fields[Value] and the
+// tags in separate dynamic Fields, as the OpenTsdbRawDecoder does.
+type InfluxLineDecoder struct {
+	runner DecoderRunner
+	helper PluginHelper
+	config *InfluxLineDecoderConfig
+	// nanoseconds per unit of the timestamps
+	scale int64
+}
+
+type InfluxLineDecoderConfig struct {
+	// Prefix for any Fields derived from tags
+	TagNamePrefix string `toml:"tagname_prefix"`
+	// Unit of the timestamps, either "ns", "us", "ms" or "s"
+	Precision string `toml:"precision"`
+	// Separator between the measurement and field names in the metric name
+	MetricSeparator string `toml:"metric_separator"`
+}
+
+func (d *InfluxLineDecoder) ConfigStruct() interface{} {
+	return &InfluxLineDecoderConfig{
+		Precision:       "ns",
+		MetricSeparator: ".",
+	}
+}
+
+func (d *InfluxLineDecoder) Init(config interface{}) error {
+	d.config = config.(*InfluxLineDecoderConfig)
+	switch d.config.Precision {
+	case "ns":
+		d.scale = 1
+	case "us":
+		d.scale = 1e3
+	case "ms":
+		d.scale = 1e6
+	case "s":
+		d.scale = 1e9
+	default:
+		return fmt.Errorf("invalid precision: '%s'", d.config.Precision)
+	}
+	return nil
+}
+
+// Implement `WantsDecoderRunner`
+func (d *InfluxLineDecoder) SetDecoderRunner(dr DecoderRunner) {
+	d.runner = dr
+}
+
+// influxPoint is a single numeric field of a line.
+type influxPoint struct {
+	metric string
+	value  interface{}
+}
+
+func (d *InfluxLineDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack,
+	err error) {
+
+	line := strings.TrimSpace(pack.Message.GetPayload())
+
+	// Ignore empty lines and comments
+	if len(line) == 0 || line[0] == '#' {
+		return
+	}
+
+	// Break into the series key, fields and (optional) timestamp
+	sections := splitUnescaped(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		err = fmt.Errorf("malformed line: '%s'", line)
+		return
+	}
+
+	key := splitUnescaped(sections[0], ',', false)
+	measurement := unescape(key[0], ", ")
+	if measurement == "" {
+		err = fmt.Errorf("missing measurement: '%s'", line)
+		return
+	}
+	var tags [][2]string
+	for _, tag := range key[1:] {
+		kv := splitUnescaped(tag, '=', false)
+		if len(kv) != 2 || kv[0] == "" {
+			err = fmt.Errorf("malformed tag '%s': '%s'", tag, line)
+			return
+		}
+		tags = append(tags, [2]string{unescape(kv[0], ",= "), unescape(kv[1], ",= ")})
+	}
+
+	var points []influxPoint
+	for _, field := range splitUnescaped(sections[1], ',', true) {
+		kv := splitUnescaped(field, '=', true)
+		if len(kv) != 2 || kv[0] == "" {
+			err = fmt.Errorf("malformed field '%s': '%s'", field, line)
+			return
+		}
+		var value interface{}
+		if value, err = parseFieldValue(kv[1]); err != nil {
+			err = fmt.Errorf("%s: '%s'", err, line)
+			return
+		}
+		// OpenTSDB only stores numbers, so strings are skipped
+		if value != nil {
+			metric := measurement + d.config.MetricSeparator + unescape(kv[0], ",= ")
+			points = append(points, influxPoint{metric: metric, value: value})
+		}
+	}
+	if len(points) == 0 {
+		err = fmt.Errorf("no numeric fields: '%s'", line)
+		return
+	}
+
+	// Use the timestamp if given, otherwise the time the line was received
+	if len(sections) == 3 {
+		var ts int64
+		if ts, err = strconv.ParseInt(sections[2], 10, 64); err != nil {
+			err = fmt.Errorf("invalid timestamp: '%s'", line)
+			return
+		}
+		pack.Message.SetTimestamp(ts * d.scale)
+	}
+	pack.Message.SetType("influx")
+
+	// A message per field, the first reusing the original pack and the rest
+	// copies of it, taken before any Fields are added
+	var base *message.Message
+	if len(points) > 1 {
+		base = pack.Message.Copy()
+	}
+	for i, p := range points {
+		np := pack
+		if i > 0 {
+			np = d.runner.NewPack()
+			np.Message = base.Copy()
+		}
+		packs = append(packs, np)
+		if err = d.addFields(np, p, tags); err != nil {
+			// the original pack is recycled by the caller on error
+			for _, extra := range packs[1:] {
+				extra.Recycle()
+			}
+			return nil, err
+		}
+	}
+	return
+}
+
+// addFields adds the Fields of a single point to a pack.
+func (d *InfluxLineDecoder) addFields(pack *PipelinePack, p influxPoint, tags [][2]string) error {
+	if err := d.addStatField(pack, "Metric", p.metric); err != nil {
+		return err
+	}
+	if err := d.addStatField(pack, "Value", p.value); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := d.addStatField(pack, d.config.TagNamePrefix+tag[0], tag[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseFieldValue parses a line protocol field value: a float, an integer
+// (with an 'i' or 'u' suffix), a boolean or a double-quoted string.  Booleans
+// are returned as 1 or 0, and strings (which can't be stored) as nil.
+func parseFieldValue(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		if len(s) < 2 || !strings.HasSuffix(s, `"`) {
+			return nil, fmt.Errorf("unterminated string value %s", s)
+		}
+		return nil, nil
+	case strings.HasSuffix(s, "i"), strings.HasSuffix(s, "u"):
+		if i, err := strconv.ParseInt(s[:len(s)-1], 10, 64); err == nil {
+			return i, nil
+		}
+		// unsigned integers too big for an int64
+		if u, err := strconv.ParseUint(s[:len(s)-1], 10, 64); err == nil && strings.HasSuffix(s, "u") {
+			return float64(u), nil
+		}
+		return nil, fmt.Errorf("invalid integer value '%s'", s)
+	}
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return int64(1), nil
+	case "f", "F", "false", "False", "FALSE":
+		return int64(0), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value '%s'", s)
+	}
+	return f, nil
+}
+
+// splitUnescaped splits s on each sep which isn't escaped with a backslash
+// (or, if quotes is set, within a double-quoted string).  The parts are
+// returned still escaped.
+func splitUnescaped(s string, sep byte, quotes bool) (parts []string) {
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && quotes:
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescape removes the backslashes escaping any of chars in s, leaving any
+// others (which line protocol treats literally).
+func unescape(s string, chars string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(chars, s[i+1]) >= 0 {
+			i++
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+func (d *InfluxLineDecoder) addStatField(pack *PipelinePack, name string,
+	value interface{}) error {
+
+	field, err := message.NewField(name, value, "")
+	if err != nil {
+		return fmt.Errorf("error adding field '%s': %s", name, err)
+	}
+	pack.Message.AddField(field)
+	return nil
+}
+
+func init() {
+	RegisterPlugin("InfluxLineDecoder", func() interface{} {
+		return new(InfluxLineDecoder)
+	})
+}
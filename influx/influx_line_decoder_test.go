@@ -0,0 +1,163 @@
+package influx
+
+import (
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"testing"
+)
+
+// testRunner hands out packs for the extra messages of multi-field lines.
+type testRunner struct {
+	DecoderRunner
+	recycle chan *PipelinePack
+}
+
+func (r *testRunner) NewPack() *PipelinePack {
+	return NewPipelinePack(r.recycle)
+}
+
+func newTestDecoder(t *testing.T, precision string) *InfluxLineDecoder {
+	d := new(InfluxLineDecoder)
+	config := d.ConfigStruct().(*InfluxLineDecoderConfig)
+	if precision != "" {
+		config.Precision = precision
+	}
+	if err := d.Init(config); err != nil {
+		t.Fatalf("Init: %s", err)
+	}
+	d.SetDecoderRunner(&testRunner{recycle: make(chan *PipelinePack, 10)})
+	return d
+}
+
+func decode(t *testing.T, d *InfluxLineDecoder, line string) []*PipelinePack {
+	pack := NewPipelinePack(make(chan *PipelinePack, 1))
+	pack.Message.SetPayload(line)
+	packs, err := d.Decode(pack)
+	if err != nil {
+		t.Fatalf("Decode(%q): %s", line, err)
+	}
+	return packs
+}
+
+func fieldValue(t *testing.T, msg *message.Message, name string) interface{} {
+	v, ok := msg.GetFieldValue(name)
+	if !ok {
+		t.Fatalf("missing Field[%s]", name)
+	}
+	return v
+}
+
+func TestDecodeMultipleFields(t *testing.T) {
+	d := newTestDecoder(t, "")
+	packs := decode(t, d, "cpu,host=a usage=1,idle=2i 1000")
+	if len(packs) != 2 {
+		t.Fatalf("got %d packs, want 2", len(packs))
+	}
+	want := []struct {
+		metric string
+		value  interface{}
+	}{{"cpu.usage", 1.0}, {"cpu.idle", int64(2)}}
+	for i, pack := range packs {
+		msg := pack.Message
+		if got := fieldValue(t, msg, "Metric"); got != want[i].metric {
+			t.Errorf("pack %d: Metric = %v, want %s", i, got, want[i].metric)
+		}
+		if got := fieldValue(t, msg, "Value"); got != want[i].value {
+			t.Errorf("pack %d: Value = %v, want %v", i, got, want[i].value)
+		}
+		if got := fieldValue(t, msg, "host"); got != "a" {
+			t.Errorf("pack %d: host = %v, want a", i, got)
+		}
+		if n := len(msg.GetFields()); n != 3 {
+			t.Errorf("pack %d: got %d Fields, want 3", i, n)
+		}
+		if ts := msg.GetTimestamp(); ts != 1000 {
+			t.Errorf("pack %d: Timestamp = %d, want 1000", i, ts)
+		}
+		if typ := msg.GetType(); typ != "influx" {
+			t.Errorf("pack %d: Type = %s, want influx", i, typ)
+		}
+	}
+}
+
+func TestDecodeEscaping(t *testing.T) {
+	d := newTestDecoder(t, "")
+	packs := decode(t, d, `my\ cpu,host\=x=a\ b\,c usage=1,note="x y=z,\"q"`)
+	if len(packs) != 1 {
+		t.Fatalf("got %d packs, want 1 (the string field is skipped)", len(packs))
+	}
+	msg := packs[0].Message
+	if got := fieldValue(t, msg, "Metric"); got != "my cpu.usage" {
+		t.Errorf("Metric = %v, want 'my cpu.usage'", got)
+	}
+	if got := fieldValue(t, msg, "host=x"); got != "a b,c" {
+		t.Errorf("tag = %v, want 'a b,c'", got)
+	}
+}
+
+func TestDecodeValues(t *testing.T) {
+	d := newTestDecoder(t, "")
+	tests := []struct {
+		line  string
+		value interface{}
+	}{
+		{"m f=1.5", 1.5},
+		{"m f=-3i", int64(-3)},
+		{"m f=18446744073709551615u", 18446744073709551615.0},
+		{"m f=t", int64(1)},
+		{"m f=FALSE", int64(0)},
+	}
+	for _, test := range tests {
+		packs := decode(t, d, test.line)
+		if got := fieldValue(t, packs[0].Message, "Value"); got != test.value {
+			t.Errorf("%q: Value = %v (%T), want %v (%T)", test.line, got, got, test.value, test.value)
+		}
+	}
+}
+
+func TestDecodePrecision(t *testing.T) {
+	d := newTestDecoder(t, "s")
+	packs := decode(t, d, "m f=1 1500000000")
+	if ts := packs[0].Message.GetTimestamp(); ts != 1500000000*1e9 {
+		t.Errorf("Timestamp = %d, want %d", ts, int64(1500000000*1e9))
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	d := newTestDecoder(t, "")
+	for _, line := range []string{
+		"m",
+		"m f=1 1 extra",
+		",host=a f=1",
+		"m,host f=1",
+		"m f=abc",
+		"m f=1.5i",
+		`m f="unterminated`,
+		`m s="only strings"`,
+		"m f=1 notatime",
+	} {
+		pack := NewPipelinePack(make(chan *PipelinePack, 1))
+		pack.Message.SetPayload(line)
+		if _, err := d.Decode(pack); err == nil {
+			t.Errorf("Decode(%q): expected an error", line)
+		}
+	}
+}
+
+func TestDecodeIgnored(t *testing.T) {
+	d := newTestDecoder(t, "")
+	for _, line := range []string{"", "  ", "# a comment"} {
+		if packs := decode(t, d, line); len(packs) != 0 {
+			t.Errorf("Decode(%q): got %d packs, want none", line, len(packs))
+		}
+	}
+}
+
+func TestInvalidPrecision(t *testing.T) {
+	d := new(InfluxLineDecoder)
+	config := d.ConfigStruct().(*InfluxLineDecoderConfig)
+	config.Precision = "m"
+	if err := d.Init(config); err == nil {
+		t.Error("expected an error for an invalid precision")
+	}
+}
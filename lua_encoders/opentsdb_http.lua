@@ -16,6 +16,17 @@ Config:
     Flush the buffer if 'flush_delta' seconds have elapsed since the last
     Timestamp and the current one.
 
+- max_batch_bytes (number, default 0)
+    If set, the maximum size of a JSON body (OpenTSDB rejects bodies over
+    its 'tsd.http.request.max_chunk' with a 413).  If a datapoint would take
+    the buffer over it, the buffer is flushed early without it, and it starts
+    the next one.  A single datapoint larger than this is rejected.
+
+- coalesce (boolean, optional, default false)
+    Keep only the last value for each metric, tag combination and timestamp
+    within a buffer (which OpenTSDB would otherwise overwrite), without it
+    counting towards flush_count again.
+
 - metric_field (string, required, default "Metric")
     Field name the metric name is stored in
 
@@ -37,6 +48,9 @@ Config:
     If no 'host' tag has been seen, append one with the value of the
     Hostname field.  Deprecated in favour of using the 'fieldfix' filter.
 
+- bool_as_int (boolean, optional, default false)
+    Emit boolean values as 1 or 0, as OpenTSDB only accepts numeric values.
+
 --]]
 
 require "cjson"
@@ -47,22 +61,44 @@ local metric_field    = read_config("metric_field") or "Metric"
 local value_field     = read_config("value_field") or "Value"
 local flush_count     = read_config("flush_count") or 1
 local flush_delta     = read_config("flush_delta") or 0
+local max_batch_bytes = read_config("max_batch_bytes") or 0
+local coalesce        = read_config("coalesce")
 local fields_to_tags  = read_config("fields_to_tags")
 local tag_prefix      = read_config("tag_prefix")
 local ts_from_message = read_config("ts_from_message")
 local add_hostname    = read_config("add_hostname_if_missing")
+local bool_as_int     = read_config("bool_as_int")
 _PRESERVATION_VERSION = read_config("preservation_version") or 0
 
 local tag_prefix_len  = tag_prefix:len()
 
+-- JSON encoded datapoints, and the size of the body they'll make
 buffer = {}
+buffer_bytes = 2
+-- position in the buffer of each series and timestamp, when coalescing
+positions = {}
 last_flush = 0
 
 function flush(ts)
-  add_to_payload(cjson.encode(buffer))
+  add_to_payload("[", table.concat(buffer, ","), "]")
   inject_payload()
   last_flush = ts
   buffer = {}
+  buffer_bytes = 2
+  positions = {}
+end
+
+-- identifies a datapoint's series and timestamp, with the tags in a stable
+-- order
+local function point_key(msg)
+  local names = {}
+  for k in pairs(msg.tags) do names[#names+1] = k end
+  table.sort(names)
+  local parts = { msg.metric, tostring(msg.timestamp) }
+  for _, k in ipairs(names) do
+    parts[#parts+1] = k .. "=" .. tostring(msg.tags[k])
+  end
+  return table.concat(parts, " ")
 end
 
 function process_message()
@@ -79,6 +115,10 @@ function process_message()
 
   if not metric or not value or not ts then return -1 end
 
+  if bool_as_int and type(value) == "boolean" then
+    if value then value = 1 else value = 0 end
+  end
+
   local msg = { timestamp = ts,
                 metric = metric,
                 value = value,
@@ -117,11 +157,45 @@ function process_message()
     msg.tags["host"] = read_message("Hostame")
   end
 
+  local point = cjson.encode(msg)
+  local key, pos
+  if coalesce then
+    key = point_key(msg)
+    pos = positions[key]
+  end
+
+  -- growth of the body, replacing a buffered datapoint or adding one (and
+  -- its delimiting comma)
+  local growth = point:len()
+  if pos then
+    growth = growth - buffer[pos]:len()
+  elseif #buffer > 0 then
+    growth = growth + 1
+  end
+
+  -- flush early, rather than exceed the maximum body size
+  local flushed = false
+  if max_batch_bytes > 0 and buffer_bytes + growth > max_batch_bytes then
+    if point:len() + 2 > max_batch_bytes then return -1 end
+    flush(ts)
+    flushed = true
+    pos = nil
+    growth = point:len()
+  end
+
   -- add message to buffer
-  buffer[#buffer+1] = msg
+  if pos then
+    buffer[pos] = point
+  else
+    buffer[#buffer+1] = point
+    if key then positions[key] = #buffer end
+  end
+  buffer_bytes = buffer_bytes + growth
 
-  -- flush the buffer
-  if flush_count > 0 and #buffer >= flush_count then
+  -- flush the buffer (only one body can be injected per message)
+  if flushed then
+    return 0
+  elseif flush_count > 0 and #buffer >= flush_count then
     flush(ts)
   elseif flush_delta > 0 and ts - last_flush > flush_delta then
     flush(ts)
@@ -0,0 +1,82 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+--[[
+Emits a synthetic "up" metric upon each timer_event, regardless of whether
+any messages have been received, so the absence of the series can be used for
+dead man's switch alerting.
+
+The message_matcher is only needed because Heka requires one, nothing is done
+with the messages it matches (so it's best pointed at a low-volume stream).
+
+The sandbox has no way of finding the local hostname, so either set the
+'hostname' option, or have the encoder add it (ie; the OpenTsdbRawEncoder's
+'add_hostname_if_missing' option, or the Lua encoders' equivalent, which
+reads the Hostname of the injected message).
+
+Config:
+- ticker_interval (uint)
+    Frequency of the heartbeat, in seconds.
+
+- metric (string, optional, default "heka.up")
+    Metric name to emit.
+
+- value (number, optional, default 1)
+    Value to emit.
+
+- hostname (string, optional)
+    If set, adds a "host" Field (tag) with this value.
+
+- tag_prefix (string, optional, default "")
+    Prefix to add to the "host" Field name.
+
+- metric_field (string, optional, default "Metric")
+    Field name to use for the metric name
+
+- value_field (string, optional, default "Value")
+    Field name to use for the metric value
+
+- msg_type (string, optional, default "heartbeat")
+    Sets the message 'Type' to the specified value (which will also have
+    'heka.sandbox.' automatically and unavoidably prefixed)
+
+*Example Heka Configuration*
+
+.. code-block:: ini
+
+    [HeartbeatFilter]
+    type = "SandboxFilter"
+    filename = "lua_filters/heartbeat.lua"
+    message_matcher = "Type == 'heka.all-report'"
+    ticker_interval = 60
+    [HeartbeatFilter.config]
+    hostname = "web1.example.com"
+
+--]]
+
+local metric       = read_config("metric") or "heka.up"
+local value        = read_config("value") or 1
+local hostname     = read_config("hostname")
+local tag_prefix   = read_config("tag_prefix") or ""
+local metric_field = read_config("metric_field") or "Metric"
+local value_field  = read_config("value_field") or "Value"
+local msg_type     = read_config("msg_type") or "heartbeat"
+
+function process_message ()
+    return 0
+end
+
+function timer_event(ns)
+    local msg = {
+      Type      = msg_type,
+      Timestamp = ns,
+      Fields    = {}
+    }
+    msg.Fields[metric_field] = metric
+    msg.Fields[value_field]  = value
+    if hostname then
+      msg.Fields[tag_prefix.."host"] = hostname
+    end
+    inject_message(msg)
+end
@@ -0,0 +1,140 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+--[[
+Relabels the tags of datapoints with an ordered list of rules (similar to
+Prometheus' relabeling), renaming tags, rewriting their values or dropping
+them.  New messages will be emitted with a new Type.
+
+Rules match with Lua patterns (rather than regular expressions) and apply in
+order, each to the result of the previous ones.  Replacements may refer to
+captures with %1, %2 etc (as in string.gsub).  Only Fields holding tags (ie;
+with the tag_prefix, and not the metric or value) are relabeled.
+
+Config:
+- rules (string)
+    Space delimited list of rules, each a '|' delimited action and its
+    arguments:
+      "key|<pattern>|<replacement>"
+        rename tags whose names match the pattern
+      "value|<key pattern>|<pattern>|<replacement>"
+        rewrite the values matching the pattern, of tags whose names match
+        the key pattern
+      "drop|<key pattern>"
+        drop tags whose names match the pattern
+    ie; "key|^k8s_(.*)|k8s.%1 value|^host$|%.example%.com$| drop|^pod_id$"
+
+- tag_prefix (string, optional, default "")
+    Prefix of the Fields holding tags (not matched by, or added by, rules).
+
+- metric_field (string, optional, default "Metric")
+    Field name the metric name is stored in
+
+- value_field (string, optional, default "Value")
+    Field name the metric value is stored in
+
+- msg_type (string, optional, default "relabel")
+    Sets the message 'Type' to the specified value (which will also have
+    'heka.sandbox.' automatically and unavoidably prefixed)
+
+*Example Heka Configuration*
+
+.. code-block:: ini
+
+    [RelabelFilter]
+    type = "SandboxFilter"
+    filename = "lua_filters/relabel.lua"
+    message_matcher = "Type == 'opentsdb'"
+    [RelabelFilter.config]
+    rules = "key|^k8s_(.*)|k8s.%1 drop|^pod_id$"
+
+--]]
+
+require "string"
+
+local rules_str    = read_config("rules") or ""
+local tag_prefix   = read_config("tag_prefix") or ""
+local metric_field = read_config("metric_field") or "Metric"
+local value_field  = read_config("value_field") or "Value"
+local msg_type     = read_config("msg_type") or "relabel"
+
+local tag_prefix_length = tag_prefix:len()
+
+-- split a rule into its '|' delimited parts, keeping empty ones
+local function split(rule)
+  local parts = {}
+  for part in (rule.."|"):gmatch("([^|]*)|") do
+    parts[#parts+1] = part
+  end
+  return parts
+end
+
+local rules = {}
+for rule in rules_str:gmatch("[%S]+") do
+  local p = split(rule)
+  local action = p[1]
+  if action == "key" and #p == 3 then
+    rules[#rules+1] = { action = action, key = p[2], replacement = p[3] }
+  elseif action == "value" and #p == 4 then
+    rules[#rules+1] = { action = action, key = p[2], pattern = p[3], replacement = p[4] }
+  elseif action == "drop" and #p == 2 then
+    rules[#rules+1] = { action = action, key = p[2] }
+  else
+    error(string.format("invalid relabel rule: '%s'", rule))
+  end
+end
+
+local function relabel(tags)
+  for _, rule in ipairs(rules) do
+    local relabeled = {}
+    for k, v in pairs(tags) do
+      if k:match(rule.key) then
+        if rule.action == "key" then
+          k = k:gsub(rule.key, rule.replacement)
+        elseif rule.action == "value" then
+          v = tostring(v):gsub(rule.pattern, rule.replacement)
+        elseif rule.action == "drop" then
+          k = nil
+        end
+      end
+      if k and k ~= "" then relabeled[k] = v end
+    end
+    tags = relabeled
+  end
+  return tags
+end
+
+function process_message ()
+
+    local msg = {
+      Timestamp = read_message("Timestamp"),
+      Hostname  = read_message("Hostname"),
+      Logger    = read_message("Logger"),
+      Type      = msg_type,
+      Fields    = {}
+    }
+
+    local tags = {}
+    while true do
+      local typ, name, value, representation, count = read_next_field()
+      if not typ then break end
+
+      if name ~= metric_field and name ~= value_field
+        and name:sub(1, tag_prefix_length) == tag_prefix then
+        tags[name:sub(tag_prefix_length+1)] = value
+      else
+        msg.Fields[name] = value
+      end
+    end
+
+    for k, v in pairs(relabel(tags)) do
+      msg.Fields[tag_prefix..k] = v
+    end
+
+    inject_message(msg)
+    return 0
+end
+
+function timer_event(ns)
+end
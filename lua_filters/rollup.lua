@@ -0,0 +1,140 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+--[[
+Stamps datapoints with the rollup aggregator and interval they should be
+stored under, so the rollup policy is defined in one place rather than by
+each output writing to OpenTSDB's rollup tables.  Messages are re-emitted
+(with all their Fields, and a new Type) with the two extra Fields.
+
+The aggregator and interval default to the 'agg' and 'interval' options, and
+can be set per metric with 'rules'.  Invalid aggregators or intervals stop
+the filter from loading.
+
+Note the extra Fields aren't meant to be tags; if the encoder converts all
+Fields to tags (ie; an empty 'tagname_prefix'), give the rollup Fields names
+it will ignore.
+
+Config:
+- agg (string, optional, default "sum")
+    Default rollup aggregator, one of "sum", "count", "min", "max" or "avg".
+
+- interval (string, optional, default "1h")
+    Default rollup interval, a number followed by a unit of "s", "m", "h",
+    "d", "w", "n" (month) or "y" (ie; "10m").
+
+- rules (string, optional)
+    Space delimited list of per-metric rules, each a Lua pattern matched
+    against the metric name, and the aggregator and interval, in the form
+    "<pattern>=<agg>:<interval>" (ie; "^web%.=max:1m ^db%.=avg:1h").  The first
+    matching rule wins, metrics matching none use the defaults.
+
+- metric_field (string, optional, default "Metric")
+    Field name the metric name is stored in
+
+- agg_field (string, optional, default "agg")
+    Field name to store the aggregator in
+
+- interval_field (string, optional, default "interval")
+    Field name to store the interval in
+
+- msg_type (string, optional, default "rollup")
+    Sets the message 'Type' to the specified value (which will also have
+    'heka.sandbox.' automatically and unavoidably prefixed)
+
+*Example Heka Configuration*
+
+.. code-block:: ini
+
+    [RollupFilter]
+    type = "SandboxFilter"
+    filename = "lua_filters/rollup.lua"
+    message_matcher = "Type == 'opentsdb'"
+    [RollupFilter.config]
+    agg = "avg"
+    interval = "1h"
+    rules = "^net%.=sum:10m"
+
+*Example Heka Message*
+
+:Timestamp: 2015-01-07 14:55:10 +0000 UTC
+:Type: heka.sandbox.rollup
+:Payload:
+:Fields:
+    | name:"Metric" type:string value:"net.bytes"
+    | name:"Value" type:double value:1024
+    | name:"host" type:string value:"test.example.com"
+    | name:"agg" type:string value:"sum"
+    | name:"interval" type:string value:"10m"
+
+--]]
+
+require "string"
+
+local agg            = read_config("agg") or "sum"
+local interval       = read_config("interval") or "1h"
+local rules_str      = read_config("rules") or ""
+local metric_field   = read_config("metric_field") or "Metric"
+local agg_field      = read_config("agg_field") or "agg"
+local interval_field = read_config("interval_field") or "interval"
+local msg_type       = read_config("msg_type") or "rollup"
+
+local aggregators = { sum = true, count = true, min = true, max = true, avg = true }
+
+local function check(a, i)
+  if not aggregators[a] then
+    error(string.format("invalid rollup aggregator: '%s'", a))
+  end
+  local n, unit = i:match("^(%d+)([smhdwny])$")
+  if not n or tonumber(n) == 0 then
+    error(string.format("invalid rollup interval: '%s'", i))
+  end
+end
+
+check(agg, interval)
+
+local rules = {}
+for rule in rules_str:gmatch("[%S]+") do
+  local pattern, a, i = rule:match("^(.+)=([^=:]+):([^=:]+)$")
+  if not pattern then
+    error(string.format("invalid rollup rule: '%s'", rule))
+  end
+  check(a, i)
+  rules[#rules+1] = { pattern = pattern, agg = a, interval = i }
+end
+
+function process_message ()
+
+    local metric = read_message("Fields["..metric_field.."]")
+    if not metric then return -1 end
+
+    local msg = {
+      Timestamp = read_message("Timestamp"),
+      Hostname  = read_message("Hostname"),
+      Logger    = read_message("Logger"),
+      Type      = msg_type,
+      Fields    = {}
+    }
+    while true do
+      local typ, name, value, representation, count = read_next_field()
+      if not typ then break end
+      msg.Fields[name] = value
+    end
+
+    msg.Fields[agg_field]      = agg
+    msg.Fields[interval_field] = interval
+    for _, rule in ipairs(rules) do
+      if metric:match(rule.pattern) then
+        msg.Fields[agg_field]      = rule.agg
+        msg.Fields[interval_field] = rule.interval
+        break
+      end
+    end
+
+    inject_message(msg)
+    return 0
+end
+
+function timer_event(ns)
+end
@@ -0,0 +1,101 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+--[[
+Converts the Graphite-style payloads generated by Heka's StatAccumInput into
+individual "metric" type events (one per line of the payload), so they can be
+encoded for OpenTSDB.
+
+Each payload line is expected to be of the form:
+
+  <metric name> <value> <unix timestamp>
+
+The metric name and value are stored in Fields, the timestamp in the message
+Timestamp.  Lines which can't be parsed are skipped.
+
+There will be a new message injected for each stat in the payload - the
+'max_process_inject' [hekad] config will need raising appropriately.
+
+Config:
+- metric_field (string, optional, default "Metric")
+    Field name to use for the metric name
+
+- value_field (string, optional, default "Value")
+    Field name to use for the metric value
+
+- tag_prefix (string, optional, default "")
+    Prefix to add to any Fields derived from tags
+
+- host_tag (bool, optional, default false)
+    Add a "host" Field (tag) with the Hostname of the StatAccumInput message.
+
+- msg_type (string, optional, default "stataccum")
+    Sets the message 'Type' to the specified value (which will also have
+    'heka.sandbox.' automatically and unavoidably prefixed)
+
+*Example Heka Configuration*
+
+.. code-block:: ini
+
+    [StatAccumInput]
+    emit_in_payload = true
+    ticker_interval = 10
+
+    [StatAccumFilter]
+    type = "SandboxFilter"
+    filename = "lua_filters/stataccum.lua"
+    message_matcher = "Type == 'heka.statmetric'"
+    [StatAccumFilter.config]
+    host_tag = true
+
+*Example Heka Message*
+
+:Timestamp: 2015-01-07 14:55:10 +0000 UTC
+:Type: heka.sandbox.stataccum
+:Payload:
+:Fields:
+    | name:"Metric" type:string value:"stats.counters.deploys.count"
+    | name:"Value" type:double value:3
+    | name:"host" type:string value:"test.example.com"
+
+--]]
+
+require "string"
+
+local metric_field = read_config("metric_field") or "Metric"
+local value_field  = read_config("value_field") or "Value"
+local tag_prefix   = read_config("tag_prefix") or ""
+local host_tag     = read_config("host_tag")
+local msg_type     = read_config("msg_type") or "stataccum"
+
+function process_message ()
+
+    local payload = read_message("Payload")
+    if not payload then return -1 end
+
+    local hostname = read_message("Hostname")
+
+    for line in payload:gmatch("[^\n]+") do
+        local metric, value, ts = line:match("^%s*(%S+)%s+(%S+)%s+(%d+)%s*$")
+        value = tonumber(value)
+
+        if metric and value then
+            local msg = {
+                Type      = msg_type,
+                Timestamp = tonumber(ts) * 1e9,
+                Fields    = {}
+            }
+            msg.Fields[metric_field] = metric
+            msg.Fields[value_field]  = value
+            if host_tag and hostname then
+                msg.Fields[tag_prefix.."host"] = hostname
+            end
+            inject_message(msg)
+        end
+    end
+
+    return 0
+end
+
+function timer_event(ns) end
@@ -45,6 +45,11 @@ Config:
     For "idle" metrics that haven't been received since the last flush (ticker_interval)
     we will send the previous seen value (for gauges) and a zero (for counters).
 
+- skip_empty_windows (bool, optional, default false)
+    When used with send_idle_stats, counters and sets which received no
+    samples since the last flush are skipped entirely rather than being sent
+    as a zero.  Gauges will still send their previous value.
+
 - send_self_stats (bool. optional, default false)
     Sends a couple of summary metrics about the number of messages received
     and the number of aggregate messages generated.
@@ -142,6 +147,7 @@ require "lpeg"
 local global_prefix       = read_config("global_prefix") or ""
 local percentiles_str     = read_config("percentiles") or "50,75,90,99"
 local send_idle           = read_config("send_idle_stats") or false
+local skip_empty          = read_config("skip_empty_windows") or false
 local self_stats          = read_config("send_self_stats") or false
 local calc_rates          = read_config("calculate_rates") or false
 local msg_type            = read_config("msg_type") or "statsd.agg"
@@ -216,6 +222,7 @@ local function send_message(msg, suffix)
 end
 
 buckets          = {}
+samples          = {}
 lastTime         = os.time() * 1e9
 metrics_received = 0
 
@@ -226,6 +233,8 @@ function process_message ()
     local sampling = read_message("Fields["..sampling_field.."]") or 1
 
     if not metric or not value or not modifier then return -1 end
+    -- a zero (or negative) sample rate would poison the aggregate with Inf/NaN
+    if sampling <= 0 then return -1 end
 
     if not buckets[metric] then
       -- create a new message template for the metric
@@ -264,6 +273,7 @@ function process_message ()
       end
     end
 
+    samples[metric]  = (samples[metric] or 0) + 1
     metrics_received = metrics_received + 1
     return 0
 end
@@ -275,7 +285,9 @@ function timer_event(ns)
     lastTime = ns
 
     local bucket_count = 0
-    for _, msg in pairs(buckets) do
+    for metric, msg in pairs(buckets) do
+
+      local empty = skip_empty and not samples[metric]
 
       -- histograms
       if msg.Fields[modifier_field] == "ms" and #msg.Fields[value_field] > 0 then
@@ -326,11 +338,13 @@ function timer_event(ns)
 
       -- counters
       elseif msg.Fields[modifier_field] == "c" then
-        send_message(msg, '.count')
+        if not empty then
+          send_message(msg, '.count')
 
-        if calc_rates then
-          msg.Fields[value_field]  = msg.Fields[value_field] / ( elapsedTime / 1e9 )
-          send_message(msg, '.rate')
+          if calc_rates then
+            msg.Fields[value_field]  = msg.Fields[value_field] / ( elapsedTime / 1e9 )
+            send_message(msg, '.rate')
+          end
         end
 
         if send_idle then msg.Fields[value_field] = 0 end
@@ -340,7 +354,7 @@ function timer_event(ns)
         local set_count = 0
         for k, _ in pairs(msg.Fields[value_field]) do set_count = set_count + 1 end
         msg.Fields[value_field] = set_count
-        send_message(msg)
+        if not empty then send_message(msg) end
 
         if send_idle then msg.Fields[value_field] = {} end
 
@@ -369,4 +383,5 @@ function timer_event(ns)
     end
 
     if not send_idle then buckets = {} end
+    samples = {}
 end
@@ -0,0 +1,143 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+--[[
+Emits a default value (zero) for any expected tag combination of a metric
+that received no datapoints during the last ticker_interval, so graphs of
+fixed-cardinality series (ie; per-partition counters) don't interpolate
+across the gaps.
+
+The real datapoints aren't re-emitted; only the "missing" ones are generated,
+upon each timer_event.  There may be up to one message per metric and tag
+combination - you may need to increase the global 'max_timer_inject' [hekad]
+configuration.
+
+For example, with metrics = "queue.depth" and
+tag_sets = "partition=0 partition=1 partition=2", if only partitions 0 and 2
+were seen during the interval, a single message will be injected:
+
+:Fields:
+    | name:"Metric" type:string value:"queue.depth"
+    | name:"Value" type:double value:0
+    | name:"partition" type:string value:"1"
+
+Config:
+- ticker_interval (uint)
+    Length of the window after which missing combinations are filled.
+
+- metrics (string)
+    Space delimited list of the metric names to zero-fill.
+
+- tag_sets (string, optional)
+    Space delimited list of the expected tag combinations.  Each combination
+    is a comma delimited list of tags, with the tag name and value delimited
+    by a '=' (ie; "dc=nyc,partition=0 dc=nyc,partition=1").  If unset, each
+    metric is filled (without tags) if it received no datapoints at all, for
+    metrics which must always report (ie; error counters).  The encoder can
+    add a host tag (ie; the OpenTsdbRawEncoder's 'add_hostname_if_missing'
+    or 'placeholder_tag' options), as OpenTSDB requires at least one.
+
+- default_value (number, optional, default 0)
+    Value to emit for a missing combination.
+
+- tag_prefix (string, optional, default "")
+    Prefix of the Fields holding tags (applied to the tag names in tag_sets).
+
+- metric_field (string, optional, default "Metric")
+    Field name the metric name is stored in
+
+- value_field (string, optional, default "Value")
+    Field name the metric value is stored in
+
+- msg_type (string, optional, default "zerofill")
+    Sets the message 'Type' to the specified value (which will also have
+    'heka.sandbox.' automatically and unavoidably prefixed)
+
+*Example Heka Configuration*
+
+.. code-block:: ini
+
+    [ZeroFillFilter]
+    type = "SandboxFilter"
+    filename = "lua_filters/zerofill.lua"
+    message_matcher = "Type == 'heka.sandbox.statsd.agg'"
+    ticker_interval = 10
+    [ZeroFillFilter.config]
+    metrics = "queue.depth queue.errors"
+    tag_sets = "partition=0 partition=1 partition=2"
+
+--]]
+
+require "string"
+
+local metrics_str   = read_config("metrics") or ""
+local tag_sets_str  = read_config("tag_sets") or ""
+local default_value = read_config("default_value") or 0
+local tag_prefix    = read_config("tag_prefix") or ""
+local metric_field  = read_config("metric_field") or "Metric"
+local value_field   = read_config("value_field") or "Value"
+local msg_type      = read_config("msg_type") or "zerofill"
+
+local metrics = {}
+for metric in metrics_str:gmatch("[%S]+") do
+  metrics[metric] = true
+end
+
+local tag_sets = {}
+for set in tag_sets_str:gmatch("[%S]+") do
+  local tags = {}
+  for k, v in set:gmatch("([^,=]+)=([^,]+)") do
+    tags[tag_prefix..k] = v
+  end
+  tag_sets[#tag_sets+1] = tags
+end
+-- a single, empty, combination matches any datapoint of the metric
+if #tag_sets == 0 then tag_sets[1] = {} end
+
+-- combinations seen during the current window, per metric
+seen = {}
+
+function process_message ()
+
+    local metric = read_message("Fields["..metric_field.."]")
+    if not metric or not metrics[metric] then return 0 end
+
+    seen[metric] = seen[metric] or {}
+    for i, tags in ipairs(tag_sets) do
+      local match = true
+      for k, v in pairs(tags) do
+        if tostring(read_message("Fields["..k.."]")) ~= v then
+          match = false
+          break
+        end
+      end
+      if match then seen[metric][i] = true end
+    end
+
+    return 0
+end
+
+function timer_event(ns)
+
+    for metric in pairs(metrics) do
+      local found = seen[metric] or {}
+      for i, tags in ipairs(tag_sets) do
+        if not found[i] then
+          local msg = {
+            Type      = msg_type,
+            Timestamp = ns,
+            Fields    = {}
+          }
+          for k, v in pairs(tags) do
+            msg.Fields[k] = v
+          end
+          msg.Fields[metric_field] = metric
+          msg.Fields[value_field]  = default_value
+          inject_message(msg)
+        end
+      end
+    end
+
+    seen = {}
+end
@@ -0,0 +1,202 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Kieren Hynd (kieren@ticketmaster.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package opentsdb
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var errDivideByZero = errors.New("division by zero")
+
+// expr is a parsed arithmetic expression, supporting +, -, *, / and
+// parentheses over numbers and numeric message Fields (referenced by name).
+type expr interface {
+	eval(field func(name string) (float64, error)) (float64, error)
+}
+
+type numberExpr float64
+
+func (n numberExpr) eval(field func(string) (float64, error)) (float64, error) {
+	return float64(n), nil
+}
+
+type fieldExpr string
+
+func (f fieldExpr) eval(field func(string) (float64, error)) (float64, error) {
+	return field(string(f))
+}
+
+type negExpr struct {
+	x expr
+}
+
+func (n negExpr) eval(field func(string) (float64, error)) (float64, error) {
+	x, err := n.x.eval(field)
+	return -x, err
+}
+
+type binaryExpr struct {
+	op   byte
+	x, y expr
+}
+
+func (b binaryExpr) eval(field func(string) (float64, error)) (float64, error) {
+	x, err := b.x.eval(field)
+	if err != nil {
+		return 0, err
+	}
+	y, err := b.y.eval(field)
+	if err != nil {
+		return 0, err
+	}
+	switch b.op {
+	case '+':
+		return x + y, nil
+	case '-':
+		return x - y, nil
+	case '*':
+		return x * y, nil
+	}
+	if y == 0 {
+		return 0, errDivideByZero
+	}
+	return x / y, nil
+}
+
+// exprFields returns the names of the Fields an expression references.
+func exprFields(e expr) (names []string) {
+	switch e := e.(type) {
+	case fieldExpr:
+		names = append(names, string(e))
+	case negExpr:
+		names = exprFields(e.x)
+	case binaryExpr:
+		names = append(exprFields(e.x), exprFields(e.y)...)
+	}
+	return
+}
+
+// exprParser is a recursive descent parser for the grammar:
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = factor { ("*" | "/") factor }
+//	factor = number | field | "(" expr ")" | "-" factor
+type exprParser struct {
+	s   string
+	pos int
+}
+
+func parseExpr(s string) (e expr, err error) {
+	p := &exprParser{s: s}
+	if e, err = p.expr(); err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected '%c' at position %d in '%s'", p.s[p.pos], p.pos, s)
+	}
+	return e, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	if p.skipSpace(); p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) expr() (expr, error) {
+	x, err := p.term()
+	for err == nil {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			break
+		}
+		p.pos++
+		var y expr
+		if y, err = p.term(); err == nil {
+			x = binaryExpr{op: op, x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) term() (expr, error) {
+	x, err := p.factor()
+	for err == nil {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			break
+		}
+		p.pos++
+		var y expr
+		if y, err = p.factor(); err == nil {
+			x = binaryExpr{op: op, x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) factor() (expr, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of '%s'", p.s)
+	case c == '(':
+		p.pos++
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ')' at position %d in '%s'", p.pos, p.s)
+		}
+		p.pos++
+		return x, nil
+	case c == '-':
+		p.pos++
+		x, err := p.factor()
+		return negExpr{x}, err
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.s) && (p.s[p.pos] == '.' || (p.s[p.pos] >= '0' && p.s[p.pos] <= '9')) {
+			p.pos++
+		}
+		n, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s' in '%s'", p.s[start:p.pos], p.s)
+		}
+		return numberExpr(n), nil
+	case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		start := p.pos
+		for p.pos < len(p.s) && isFieldChar(p.s[p.pos]) {
+			p.pos++
+		}
+		return fieldExpr(p.s[start:p.pos]), nil
+	}
+	return nil, fmt.Errorf("unexpected '%c' at position %d in '%s'", c, p.pos, p.s)
+}
+
+func isFieldChar(c byte) bool {
+	return c == '_' || c == '.' || (c >= '0' && c <= '9') ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
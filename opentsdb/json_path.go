@@ -0,0 +1,71 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Kieren Hynd (kieren@ticketmaster.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package opentsdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPathValue extracts a numeric value from a JSON document using a simple
+// dotted path (eg; "stats.cpu[2].idle"), where "[n]" indexes into an array.
+func jsonPathValue(doc string, path string) (value json.Number, err error) {
+	dec := json.NewDecoder(strings.NewReader(doc))
+	dec.UseNumber()
+	var node interface{}
+	if err = dec.Decode(&node); err != nil {
+		return "", fmt.Errorf("can't parse JSON payload: %s", err)
+	}
+
+	for _, segment := range strings.Split(path, ".") {
+		// split any array indexes from the key
+		key := segment
+		var indexes []string
+		if i := strings.Index(segment, "["); i >= 0 {
+			key = segment[:i]
+			indexes = strings.Split(strings.TrimSuffix(segment[i+1:], "]"), "][")
+		}
+
+		if key != "" {
+			obj, ok := node.(map[string]interface{})
+			if !ok {
+				return "", fmt.Errorf("path '%s' not found: '%s' is not an object", path, key)
+			}
+			if node, ok = obj[key]; !ok {
+				return "", fmt.Errorf("path '%s' not found: no key '%s'", path, key)
+			}
+		}
+
+		for _, index := range indexes {
+			n, err := strconv.Atoi(index)
+			if err != nil {
+				return "", fmt.Errorf("invalid array index in path '%s': '%s'", path, index)
+			}
+			arr, ok := node.([]interface{})
+			if !ok || n < 0 || n >= len(arr) {
+				return "", fmt.Errorf("path '%s' not found: no index %d", path, n)
+			}
+			node = arr[n]
+		}
+	}
+
+	value, ok := node.(json.Number)
+	if !ok {
+		return "", fmt.Errorf("value at path '%s' is not numeric", path)
+	}
+	return value, nil
+}
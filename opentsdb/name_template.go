@@ -0,0 +1,69 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Kieren Hynd (kieren@ticketmaster.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package opentsdb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// nameTemplate maps the dotted segments of a Graphite-style metric name to
+// tags (eg; "servers.{host}.{metric}.{metric}").  Each segment of the
+// template is either a literal, which must match, a "{tag}" whose segment
+// becomes the value of that tag, or "{metric}", whose segments are joined
+// (in order) to form the residual metric name.
+type nameTemplate []string
+
+func parseNameTemplate(s string) (nameTemplate, error) {
+	t := nameTemplate(strings.Split(s, "."))
+	hasMetric := false
+	for _, segment := range t {
+		switch {
+		case segment == "":
+			return nil, fmt.Errorf("empty segment in name template '%s'", s)
+		case segment == "{metric}":
+			hasMetric = true
+		case segment == "{}":
+			return nil, fmt.Errorf("empty tag name in name template '%s'", s)
+		}
+	}
+	if !hasMetric {
+		return nil, fmt.Errorf("name template '%s' has no {metric} segment", s)
+	}
+	return t, nil
+}
+
+// match splits name according to the template, returning the residual
+// metric name and the tags (as name, value pairs, in template order).  ok is
+// false if the name has a different number of segments, or a literal
+// segment doesn't match.
+func (t nameTemplate) match(name string) (metric string, tags [][2]string, ok bool) {
+	segments := strings.Split(name, ".")
+	if len(segments) != len(t) {
+		return "", nil, false
+	}
+	var parts []string
+	for i, segment := range t {
+		switch {
+		case segment == "{metric}":
+			parts = append(parts, segments[i])
+		case strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}"):
+			tags = append(tags, [2]string{segment[1 : len(segment)-1], segments[i]})
+		case segment != segments[i]:
+			return "", nil, false
+		}
+	}
+	return strings.Join(parts, "."), tags, true
+}
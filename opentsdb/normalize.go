@@ -0,0 +1,118 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Kieren Hynd (kieren@ticketmaster.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package opentsdb
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+)
+
+// NormalizeConfig controls the normalization of metric names, tag names and
+// tag values.  It's shared by the encoder and decoder (as a 'normalize' config
+// table) so that names survive a round trip through both unchanged.
+type NormalizeConfig struct {
+	// Lowercase metric and tag names
+	Lowercase bool `toml:"lowercase"`
+	// Replace any characters OpenTSDB doesn't allow with an underscore
+	Sanitize bool `toml:"sanitize"`
+	// Transliterate accented Latin letters to ASCII (ie; 'é' to 'e')
+	Transliterate bool `toml:"transliterate"`
+	// Allow any Unicode letter when sanitizing (as OpenTSDB 2.x does)
+	unicode bool
+}
+
+// name normalizes a metric or tag name.
+func (n *NormalizeConfig) name(s string) string {
+	if n.Lowercase {
+		s = strings.ToLower(s)
+	}
+	return n.value(s)
+}
+
+// value normalizes a tag value (which keeps its case).
+func (n *NormalizeConfig) value(s string) string {
+	if n.Transliterate {
+		s = transliterate(s)
+	}
+	if n.Sanitize {
+		s = strings.Map(func(r rune) rune {
+			if n.unicode && unicode.IsLetter(r) {
+				return r
+			}
+			return sanitizeRune(r)
+		}, s)
+	}
+	return s
+}
+
+// sanitizeRune replaces anything outside OpenTSDB's allowed set of
+// characters (a-z, A-Z, 0-9, '-', '_', '.' and '/') with an underscore.
+func sanitizeRune(r rune) rune {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return r
+	case r == '-', r == '_', r == '.', r == '/':
+		return r
+	}
+	return '_'
+}
+
+// transliterations maps accented Latin letters to their ASCII equivalents.
+var transliterations = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'þ': "th", 'Þ': "TH",
+}
+
+func init() {
+	for ascii, accented := range map[string]string{
+		"a": "àáâãäåāăą", "A": "ÀÁÂÃÄÅĀĂĄ",
+		"c": "çćĉċč", "C": "ÇĆĈĊČ",
+		"d": "ďđð", "D": "ĎĐÐ",
+		"e": "èéêëēĕėęě", "E": "ÈÉÊËĒĔĖĘĚ",
+		"g": "ĝğġģ", "G": "ĜĞĠĢ",
+		"h": "ĥħ", "H": "ĤĦ",
+		"i": "ìíîïĩīĭįı", "I": "ÌÍÎÏĨĪĬĮİ",
+		"j": "ĵ", "J": "Ĵ",
+		"k": "ķ", "K": "Ķ",
+		"l": "ĺļľŀł", "L": "ĹĻĽĿŁ",
+		"n": "ñńņň", "N": "ÑŃŅŇ",
+		"o": "òóôõöøōŏő", "O": "ÒÓÔÕÖØŌŎŐ",
+		"r": "ŕŗř", "R": "ŔŖŘ",
+		"s": "śŝşš", "S": "ŚŜŞŠ",
+		"t": "ţťŧ", "T": "ŢŤŦ",
+		"u": "ùúûüũūŭůűų", "U": "ÙÚÛÜŨŪŬŮŰŲ",
+		"w": "ŵ", "W": "Ŵ",
+		"y": "ýÿŷ", "Y": "ÝŸŶ",
+		"z": "źżž", "Z": "ŹŻŽ",
+	} {
+		for _, r := range accented {
+			transliterations[r] = ascii
+		}
+	}
+}
+
+// transliterate replaces any accented Latin letters in s with ASCII, leaving
+// anything else (for sanitizing) as it is.
+func transliterate(s string) string {
+	var b bytes.Buffer
+	for _, r := range s {
+		if ascii, ok := transliterations[r]; ok {
+			b.WriteString(ascii)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -30,11 +30,19 @@ type OpenTsdbRawDecoder struct {
 	runner DecoderRunner
 	helper PluginHelper
 	config *OpenTsdbRawDecoderConfig
+	// parsed NameToTags
+	templates []nameTemplate
 }
 
 type OpenTsdbRawDecoderConfig struct {
 	// Prefix for any Fields derived from tags
 	TagNamePrefix string `toml:"tagname_prefix"`
+	// Normalization of metric and tag names
+	Normalize NormalizeConfig `toml:"normalize"`
+	// Templates mapping the dotted segments of metric names to tags
+	NameToTags []string `toml:"name_to_tags"`
+	// Return an error for metric names matching none of the NameToTags
+	NameToTagsStrict bool `toml:"name_to_tags_strict"`
 }
 
 func (d *OpenTsdbRawDecoder) ConfigStruct() interface{} {
@@ -43,6 +51,13 @@ func (d *OpenTsdbRawDecoder) ConfigStruct() interface{} {
 
 func (d *OpenTsdbRawDecoder) Init(config interface{}) error {
 	d.config = config.(*OpenTsdbRawDecoderConfig)
+	for _, s := range d.config.NameToTags {
+		t, err := parseNameTemplate(s)
+		if err != nil {
+			return fmt.Errorf("invalid name_to_tags: %s", err)
+		}
+		d.templates = append(d.templates, t)
+	}
 	return nil
 }
 
@@ -87,8 +102,26 @@ func (d *OpenTsdbRawDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack,
 	}
 	pack.Message.SetTimestamp(time.Unix(int64(unixTime), 0).UnixNano())
 
+	// Split any tags out of the metric name, using the first matching template
+	metric := fields[0]
+	var nameTags [][2]string
+	if len(d.templates) > 0 {
+		matched := false
+		for _, t := range d.templates {
+			var m string
+			if m, nameTags, matched = t.match(metric); matched {
+				metric = m
+				break
+			}
+		}
+		if !matched && d.config.NameToTagsStrict {
+			err = fmt.Errorf("metric name matches no name_to_tags template: '%s'", line)
+			return
+		}
+	}
+
 	// Add metric to the main message.
-	if err = d.addStatField(pack, "Metric", fields[0]); err != nil {
+	if err = d.addStatField(pack, "Metric", d.config.Normalize.name(metric)); err != nil {
 		return
 	}
 
@@ -107,10 +140,17 @@ func (d *OpenTsdbRawDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack,
 	}
 
 	// Add any tags
+	for _, tag := range nameTags {
+		name := d.config.TagNamePrefix + d.config.Normalize.name(tag[0])
+		if err = d.addStatField(pack, name, d.config.Normalize.value(tag[1])); err != nil {
+			return
+		}
+	}
 	for _, tag := range fields[3:] {
 		x := strings.SplitN(tag, "=", 2)
 		if len(x) == 2 {
-			if err = d.addStatField(pack, d.config.TagNamePrefix+x[0], x[1]); err != nil {
+			name := d.config.TagNamePrefix + d.config.Normalize.name(x[0])
+			if err = d.addStatField(pack, name, d.config.Normalize.value(x[1])); err != nil {
 				return
 			}
 		}
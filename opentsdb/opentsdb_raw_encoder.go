@@ -16,26 +16,88 @@ package opentsdb
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
+	"log"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+// dedupe tracks the state of a series in the dedupe buffer.  Only the values
+// needed to regenerate a withheld line are kept, the metric name and tags
+// come from the buffer's key.
 type dedupe struct {
-	data    []byte
-	skipped bool
-	ts      int64
+	split   int   // length of the metric name within the key
+	skipped bool  // whether a datapoint is currently withheld
+	ts      int64 // timestamp (ns) of the last datapoint sent
+	first   int64 // timestamp (ns) of the first datapoint seen
+	last    int64 // timestamp (s) of the withheld datapoint
 	val     interface{}
 }
 
 // OpenTsdbRawEncoder generates a 'raw', line-based format of a message
 // suitable for ingest into OpenTSDB over TCP.
 type OpenTsdbRawEncoder struct {
+	// counters for ReportMsg, updated atomically (and kept first, for
+	// 64-bit alignment)
+	encodedCount  int64
+	skippedCount  int64
+	errorCount    int64
+	bufferedCount int64
+
 	config       *OpenTsdbRawEncoderConfig
 	dedupeBuffer map[string]dedupe
 	missingTags  map[string]string
 	overrideTags map[string]string
+	allowedTypes map[string]bool
+	tagsExempt   map[string]bool
+	// Fields which are never converted to tags
+	notTags map[string]bool
+	// recently returned errors, for rate-limiting
+	errorLog map[string]*loggedError
+	// parsed ValueExpr
+	valueExpr expr
+	// compiled LoggerTagPattern
+	loggerTags *regexp.Regexp
+	// source of the current time, replaceable for testing
+	nowFunc func() time.Time
+	// first timestamp seen, when rebasing timestamps onto FixedBaseTimestamp
+	firstSeen time.Time
+	// distinct values seen per tag name, up to MaxValuesPerTagKey
+	tagValues map[string]map[string]bool
+	// tag sources, in order of increasing precedence
+	tagSources []string
+	// series which have crossed EmitThreshold, and not yet been reset
+	crossedSeries map[string]bool
+	// parsed PlaceholderTag, as name and value
+	placeholderTag []string
+	// the last datapoint of the current DedupeBucket, per series
+	buckets map[string]point
+	// the current DedupeBucket, of the latest datapoint seen in any series
+	bucket int64
+	// messages received since inputStart (the start of the current
+	// InputRateInterval), for the input rate
+	inputCount int64
+	inputStart time.Time
+	// input rate datapoints not yet returned
+	inputPending []byte
+	// tags of the input rate datapoints
+	inputTags string
 }
 
 type OpenTsdbRawEncoderConfig struct {
@@ -49,29 +111,432 @@ type OpenTsdbRawEncoderConfig struct {
 	FieldsToTags bool `toml:"fields_to_tags"`
 	// Maximum window size (seconds) for dedupe
 	DedupeFlush int64 `toml:"dedupe_window"`
+	// Field whose numeric value overrides DedupeFlush for that datapoint
+	DedupeWindowField string `toml:"dedupe_window_field"`
 	// Array of static tags to add if missing
 	AddTagsIfMissing []string `toml:"tags_if_missing"`
 	// Array of static tags to override unconditionally
 	AddTagsOverride []string `toml:"tags_override"`
+	// Emit boolean values as 1 or 0
+	BoolAsInt bool `toml:"bool_as_int"`
+	// Add a 'host' tag with the local hostname if one isn't present
+	AddHostnameIfMissing bool `toml:"add_hostname_if_missing"`
+	// Resolve the local hostname to its FQDN
+	HostnameFqdn bool `toml:"hostname_fqdn"`
+	// Maximum length of a metric name, in bytes
+	MaxMetricNameBytes int `toml:"max_metric_name_bytes"`
+	// What to do with over-long metric names, either "drop" or "truncate"
+	MetricNameAction string `toml:"metric_name_action"`
+	// Dotted path to extract the value from a JSON payload, instead of Field[Value]
+	ValueJsonPath string `toml:"value_json_path"`
+	// Return an error for malformed embedded tags, rather than dropping them
+	StrictEmbeddedTags bool `toml:"strict_embedded_tags"`
+	// Seconds to add to the timestamp, for sources with a non-Unix epoch
+	TimestampEpochOffset int64 `toml:"timestamp_epoch_offset"`
+	// Also emit each datapoint without its 'host' tag
+	EmitHostless bool `toml:"emit_hostless"`
+	// Suffix for the metric name of the host-less datapoints
+	HostlessSuffix string `toml:"hostless_suffix"`
+	// Message Types to encode, all others are skipped (empty allows any)
+	AllowedTypes []string `toml:"allowed_types"`
+	// Per tag lookup tables for translating tag values (tagk -> from -> to)
+	TagValueMap map[string]map[string]string `toml:"tag_value_map"`
+	// Normalization of metric and tag names
+	Normalize NormalizeConfig `toml:"normalize"`
+	// Maximum length of a tag value, in bytes
+	MaxTagValueBytes int `toml:"max_tag_value_bytes"`
+	// What to do with over-long tag values, either "drop" or "truncate"
+	TagValueAction string `toml:"tag_value_action"`
+	// Maximum number of tags per datapoint
+	MaxTags int `toml:"max_tags"`
+	// Metric names exempt from MaxTags
+	MaxTagsExempt []string `toml:"max_tags_exempt"`
+	// Major version of OpenTSDB being written to, either "1" or "2"
+	OpenTsdbVersion string `toml:"opentsdb_version"`
+	// String to replace any dots in tag names with
+	TagKeyDotReplacement string `toml:"tagkey_dot_replacement"`
+	// Field holding a list of timestamps (seconds) to emit the datapoint at
+	TimestampsField string `toml:"timestamps_field"`
+	// Minimum interval (seconds) between returning identical errors
+	ErrorLogInterval int64 `toml:"error_log_interval"`
+	// Arithmetic expression over numeric Fields to compute the value from
+	ValueExpr string `toml:"value_expr"`
+	// What to do when ValueExpr divides by zero, either "skip" or "default"
+	ValueExprDivZero string `toml:"value_expr_div_zero"`
+	// Value to use when ValueExpr divides by zero, with the "default" action
+	ValueExprDefault float64 `toml:"value_expr_default"`
+	// Regex whose named capture groups extract tags from the message Logger
+	LoggerTagPattern string `toml:"logger_tag_pattern"`
+	// Treat commas in string values as decimal separators
+	DecimalComma bool `toml:"decimal_comma"`
+	// Lowest value allowed
+	MinValue *float64 `toml:"min_value"`
+	// Highest value allowed
+	MaxValue *float64 `toml:"max_value"`
+	// What to do with out of range values, either "drop" or "clamp"
+	RangeAction string `toml:"range_action"`
+	// Precede each message's lines with a comment line holding its UUID
+	DebugComments bool `toml:"debug_comments"`
+	// Field holding a pre-formatted tag string to append verbatim
+	RawTagsField string `toml:"raw_tags_field"`
+	// Name of a tag holding an id generated for this encoder instance
+	InstanceTag string `toml:"instance_tag"`
+	// Drop tags with empty values, rather than using EmptyTagValue
+	DropEmptyTags bool `toml:"drop_empty_tags"`
+	// Placeholder value for empty tags, when they aren't dropped
+	EmptyTagValue string `toml:"empty_tag_value"`
+	// Fields to emit as separate metrics (Field name -> metric name)
+	ValueFieldMetricMap map[string]string `toml:"value_field_metric_map"`
+	// Prefix for the metric names in ValueFieldMetricMap
+	ValueFieldMetricPrefix string `toml:"value_field_metric_prefix"`
+	// Trim leading and trailing whitespace from metric names
+	TrimMetricName bool `toml:"trim_metric_name"`
+	// Collapse runs of whitespace within metric names to a single space
+	CollapseMetricSpaces bool `toml:"collapse_metric_spaces"`
+	// Rebase timestamps relative to the first seen onto this (seconds), for testing
+	FixedBaseTimestamp int64 `toml:"fixed_base_timestamp"`
+	// Maximum number of distinct values per tag name, datapoints with new values are dropped
+	MaxValuesPerTagKey int `toml:"max_values_per_tag_key"`
+	// Also emit the number of tags of each datapoint, tagged by metric name
+	EmitTagCount bool `toml:"emit_tag_count"`
+	// Metric name for the EmitTagCount datapoints
+	TagCountMetric string `toml:"tag_count_metric"`
+	// Numeric Field holding the timestamp, overriding TsFromMessage
+	TimestampField string `toml:"timestamp_field"`
+	// Tag sources ("logger", "fields" and "embedded"), highest precedence first
+	SourcePrecedence []string `toml:"source_precedence"`
+	// Emit tags sorted by name, as OpenTSDB orders them in a TSUID
+	CanonicalTagOrder bool `toml:"canonical_tag_order"`
+	// Write tab-aligned columns for debugging, rather than 'put' lines
+	HumanReadable bool `toml:"human_readable"`
+	// Never dedupe a value lower than the last sent (ie; a counter reset)
+	DedupeEmitOnDecrease bool `toml:"dedupe_emit_on_decrease"`
+	// Position of the value in 'put' lines, either "before_tags" or "after_tags"
+	ValuePosition string `toml:"value_position"`
+	// Dedupe values within this percentage of the last value sent
+	DedupePercentTolerance float64 `toml:"dedupe_percent_tolerance"`
+	// Emit pre-aggregated sum and count Fields as '.sum' and '.count' metrics
+	SumCount bool `toml:"sum_count"`
+	// Only emit values crossing this threshold
+	EmitThreshold *float64 `toml:"emit_threshold"`
+	// Direction values must cross EmitThreshold in, either "above" or "below"
+	EmitThresholdDirection string `toml:"emit_threshold_direction"`
+	// Threshold values must cross back over before crossing EmitThreshold again
+	EmitThresholdReset *float64 `toml:"emit_threshold_reset"`
+	// Seconds from a series' first datapoint during which dedupe withholds nothing
+	DedupeWarmup int64 `toml:"dedupe_warmup"`
+	// Field whose (sanitized) value is appended to metric names, after a dot
+	MetricSuffixField string `toml:"metric_suffix_field"`
+	// What to do with different values at the same timestamp for a series,
+	// either "last", "first", "error" or "sum"
+	TimestampCollisionAction string `toml:"timestamp_collision_action"`
+	// Write a JSON object per line, rather than 'put' lines
+	NdJson bool `toml:"ndjson"`
+	// Remove any 'host' tag, from all sources (overriding AddHostnameIfMissing)
+	DropHostTag bool `toml:"drop_host_tag"`
+	// Field holding tag values packed positionally (ie; "web1|us-east|prod")
+	PositionalTagsField string `toml:"positional_tags_field"`
+	// Tag names for each position of PositionalTagsField
+	PositionalTagKeys []string `toml:"positional_tag_keys"`
+	// Delimiter between the positions of PositionalTagsField
+	PositionalTagsDelimiter string `toml:"positional_tags_delimiter"`
+	// Return an error if PositionalTagsField doesn't have one value per key
+	PositionalTagsStrict bool `toml:"positional_tags_strict"`
+	// Emit a datapoint for each element of a multi-valued Field[Value]
+	MultiValue bool `toml:"multi_value"`
+	// Seconds to spread the elements of a multi-valued Field[Value] over
+	ValueSpread int64 `toml:"value_spread"`
+	// Tag (name=value) to add to datapoints which would otherwise have none
+	PlaceholderTag string `toml:"placeholder_tag"`
+	// Return an error for datapoints with no tags (and no PlaceholderTag)
+	RequireTags bool `toml:"require_tags"`
+	// Name of a tag to add the message Severity as, if it's not already set
+	SeverityTag string `toml:"severity_tag"`
+	// Use the message Severity as the value, instead of Field[Value]
+	SeverityAsValue bool `toml:"severity_as_value"`
+	// Value to emit for every message, ignoring any value it has
+	ConstantValue *float64 `toml:"constant_value"`
+	// Value for tags from empty Fields, which flag their presence
+	PresenceTagValue string `toml:"presence_tag_value"`
+	// Seconds of the buckets bursts of datapoints are collapsed into
+	DedupeBucket int64 `toml:"dedupe_bucket"`
+	// Seconds between datapoints of the encoder's input rate (messages/sec)
+	InputRateInterval int64 `toml:"input_rate_interval"`
+	// Metric name for the InputRateInterval datapoints
+	InputRateMetric string `toml:"input_rate_metric"`
+	// Decimal places to round float values to
+	ValueRound *int `toml:"value_round"`
+	// Field holding the sum, with SumCount
+	SumField string `toml:"sum_field"`
+	// Field holding the count, with SumCount
+	CountField string `toml:"count_field"`
+	// Emit a histogram's buckets as a series per bucket
+	Histogram bool `toml:"histogram"`
+	// Field holding the upper bounds of the histogram buckets
+	HistogramBoundsField string `toml:"histogram_bounds_field"`
+	// Field holding the counts of the histogram buckets
+	HistogramCountsField string `toml:"histogram_counts_field"`
 }
 
 func (oe *OpenTsdbRawEncoder) ConfigStruct() interface{} {
 	return &OpenTsdbRawEncoderConfig{
-		TsFromMessage: true,
-		FieldsToTags:  true,
+		TsFromMessage:            true,
+		FieldsToTags:             true,
+		MetricNameAction:         "drop",
+		TagValueAction:           "drop",
+		ValueExprDivZero:         "skip",
+		RangeAction:              "drop",
+		DropEmptyTags:            true,
+		TagCountMetric:           "heka.opentsdb.tagcount",
+		ValuePosition:            "before_tags",
+		SumField:                 "Sum",
+		CountField:               "Count",
+		EmitThresholdDirection:   "above",
+		HistogramBoundsField:     "Bounds",
+		HistogramCountsField:     "Counts",
+		TimestampCollisionAction: "last",
+		PositionalTagsDelimiter:  "|",
+		InputRateMetric:          "heka.opentsdb.input_rate",
 	}
 }
 
+// defaultSourcePrecedence is the default order of precedence between the tag
+// sources, highest first.
+var defaultSourcePrecedence = []string{"logger", "fields", "embedded"}
+
+// validate checks for contradictory combinations of options, which would
+// otherwise be silently ignored or misbehave at runtime.
+func (c *OpenTsdbRawEncoderConfig) validate() error {
+	switch c.RangeAction {
+	case "drop", "clamp":
+	default:
+		return fmt.Errorf("invalid range_action: '%s'", c.RangeAction)
+	}
+	switch c.TimestampCollisionAction {
+	case "last", "first", "error", "sum":
+	default:
+		return fmt.Errorf("invalid timestamp_collision_action: '%s'", c.TimestampCollisionAction)
+	}
+	switch c.EmitThresholdDirection {
+	case "above", "below":
+	default:
+		return fmt.Errorf("invalid emit_threshold_direction: '%s'", c.EmitThresholdDirection)
+	}
+	switch c.ValuePosition {
+	case "before_tags", "after_tags":
+	default:
+		return fmt.Errorf("invalid value_position: '%s'", c.ValuePosition)
+	}
+	switch c.ValueExprDivZero {
+	case "skip", "default":
+	default:
+		return fmt.Errorf("invalid value_expr_div_zero: '%s'", c.ValueExprDivZero)
+	}
+	switch c.MetricNameAction {
+	case "drop", "truncate":
+	default:
+		return fmt.Errorf("invalid metric_name_action: '%s'", c.MetricNameAction)
+	}
+	switch c.TagValueAction {
+	case "drop", "truncate":
+	default:
+		return fmt.Errorf("invalid tag_value_action: '%s'", c.TagValueAction)
+	}
+	switch c.OpenTsdbVersion {
+	case "", "1", "2":
+	default:
+		return fmt.Errorf("invalid opentsdb_version: '%s'", c.OpenTsdbVersion)
+	}
+	for _, source := range c.SourcePrecedence {
+		switch source {
+		case "logger", "fields", "embedded":
+		default:
+			return fmt.Errorf("invalid source_precedence: '%s'", source)
+		}
+	}
+	if c.PlaceholderTag != "" {
+		kv := strings.SplitN(c.PlaceholderTag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("invalid placeholder_tag: '%s'", c.PlaceholderTag)
+		}
+	}
+	if c.LoggerTagPattern != "" {
+		if _, err := regexp.Compile(c.LoggerTagPattern); err != nil {
+			return fmt.Errorf("invalid logger_tag_pattern: %s", err)
+		}
+	}
+	if c.ValueExpr != "" {
+		if _, err := parseExpr(c.ValueExpr); err != nil {
+			return fmt.Errorf("invalid value_expr: %s", err)
+		}
+	}
+
+	dedupe := c.DedupeFlush > 0 || c.DedupeWindowField != ""
+	switch {
+	case c.TagValuePrefix != "" && c.TagNamePrefix == "":
+		return errors.New("tagvalue_prefix requires tagname_prefix")
+	case c.StrictEmbeddedTags && c.TagNamePrefix == "":
+		return errors.New("strict_embedded_tags requires tagname_prefix")
+	case c.HostnameFqdn && !c.AddHostnameIfMissing:
+		return errors.New("hostname_fqdn requires add_hostname_if_missing")
+	case c.EmitHostless && c.HostlessSuffix == "":
+		return errors.New("emit_hostless requires a hostless_suffix, or the datapoints would collide")
+	case c.ValueExpr != "" && c.ValueJsonPath != "":
+		return errors.New("value_expr and value_json_path are mutually exclusive")
+	case len(c.ValueFieldMetricMap) > 0 && (c.ValueExpr != "" || c.ValueJsonPath != ""):
+		return errors.New("value_field_metric_map can't be used with value_expr or value_json_path")
+	case c.SumCount && (len(c.ValueFieldMetricMap) > 0 || c.ValueExpr != "" || c.ValueJsonPath != ""):
+		return errors.New("sum_count can't be used with value_field_metric_map, value_expr or value_json_path")
+	case c.Histogram && (c.SumCount || len(c.ValueFieldMetricMap) > 0 || c.ValueExpr != "" || c.ValueJsonPath != ""):
+		return errors.New("histogram can't be used with sum_count, value_field_metric_map, value_expr or value_json_path")
+	case c.ValueFieldMetricPrefix != "" && len(c.ValueFieldMetricMap) == 0:
+		return errors.New("value_field_metric_prefix requires value_field_metric_map")
+	case c.MinValue != nil && c.MaxValue != nil && *c.MinValue > *c.MaxValue:
+		return fmt.Errorf("min_value (%v) is greater than max_value (%v)", *c.MinValue, *c.MaxValue)
+	case c.EmitThresholdReset != nil && c.EmitThreshold == nil:
+		return errors.New("emit_threshold_reset requires emit_threshold")
+	case c.EmitThresholdReset != nil && c.EmitThresholdDirection == "above" &&
+		*c.EmitThresholdReset > *c.EmitThreshold:
+		return fmt.Errorf("emit_threshold_reset (%v) is above emit_threshold (%v)",
+			*c.EmitThresholdReset, *c.EmitThreshold)
+	case c.EmitThresholdReset != nil && c.EmitThresholdDirection == "below" &&
+		*c.EmitThresholdReset < *c.EmitThreshold:
+		return fmt.Errorf("emit_threshold_reset (%v) is below emit_threshold (%v)",
+			*c.EmitThresholdReset, *c.EmitThreshold)
+	case c.MultiValue && (c.SumCount || c.Histogram || len(c.ValueFieldMetricMap) > 0 ||
+		c.ValueExpr != "" || c.ValueJsonPath != ""):
+		return errors.New("multi_value can't be used with sum_count, histogram, value_field_metric_map, value_expr or value_json_path")
+	case c.SeverityAsValue && (c.SumCount || c.Histogram || c.MultiValue || len(c.ValueFieldMetricMap) > 0 ||
+		c.ValueExpr != "" || c.ValueJsonPath != ""):
+		return errors.New("severity_as_value can't be used with another source of values")
+	case c.ConstantValue != nil && (c.SeverityAsValue || c.SumCount || c.Histogram || c.MultiValue ||
+		len(c.ValueFieldMetricMap) > 0 || c.ValueExpr != "" || c.ValueJsonPath != ""):
+		return errors.New("constant_value can't be used with another source of values")
+	case c.ValueSpread < 0:
+		return fmt.Errorf("value_spread (%d) can't be negative", c.ValueSpread)
+	case c.PositionalTagsField != "" && len(c.PositionalTagKeys) == 0:
+		return errors.New("positional_tags_field requires positional_tag_keys")
+	case c.PositionalTagsField != "" && c.PositionalTagsDelimiter == "":
+		return errors.New("positional_tags_delimiter can't be empty")
+	case c.InputRateInterval > 0 && c.DropHostTag && c.PlaceholderTag == "":
+		return errors.New("input_rate_interval with drop_host_tag requires a placeholder_tag")
+	case c.DropHostTag && c.EmitHostless:
+		return errors.New("emit_hostless can't be used with drop_host_tag")
+	case c.NdJson && c.HumanReadable:
+		return errors.New("ndjson and human_readable are mutually exclusive")
+	case c.ValueRound != nil && *c.ValueRound < 0:
+		return fmt.Errorf("value_round (%d) can't be negative", *c.ValueRound)
+	case c.InputRateInterval < 0:
+		return fmt.Errorf("input_rate_interval (%d) can't be negative", c.InputRateInterval)
+	case c.DedupeBucket < 0:
+		return fmt.Errorf("dedupe_bucket (%d) can't be negative", c.DedupeBucket)
+	case c.DedupeWarmup < 0:
+		return fmt.Errorf("dedupe_warmup (%d) can't be negative", c.DedupeWarmup)
+	case c.DedupePercentTolerance < 0:
+		return fmt.Errorf("dedupe_percent_tolerance (%v) can't be negative", c.DedupePercentTolerance)
+	case c.EmptyTagValue != "" && c.DropEmptyTags:
+		return errors.New("empty_tag_value is only used if drop_empty_tags is false")
+	case c.EmptyTagValue == "" && !c.DropEmptyTags:
+		return errors.New("empty_tag_value must be set if drop_empty_tags is false")
+	case !dedupe && c.DedupeWarmup > 0:
+		return errors.New("dedupe_warmup requires dedupe_window or dedupe_window_field")
+	case !dedupe && c.DedupePercentTolerance > 0:
+		return errors.New("dedupe_percent_tolerance requires dedupe_window or dedupe_window_field")
+	case !dedupe && c.DedupeEmitOnDecrease:
+		return errors.New("dedupe_emit_on_decrease requires dedupe_window or dedupe_window_field")
+	case !dedupe && c.TimestampCollisionAction != "last":
+		return errors.New("timestamp_collision_action requires dedupe_window or dedupe_window_field")
+	}
+	return nil
+}
+
 func (oe *OpenTsdbRawEncoder) Init(config interface{}) (err error) {
 	oe.config = config.(*OpenTsdbRawEncoderConfig)
+	if err = oe.config.validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %s", err)
+	}
 	oe.dedupeBuffer = make(map[string]dedupe)
 	oe.missingTags = make(map[string]string)
 	oe.overrideTags = make(map[string]string)
+	oe.allowedTypes = make(map[string]bool)
+	oe.tagsExempt = make(map[string]bool)
+	oe.errorLog = make(map[string]*loggedError)
+	oe.tagValues = make(map[string]map[string]bool)
+	oe.crossedSeries = make(map[string]bool)
+	oe.buckets = make(map[string]point)
+	oe.bucket = math.MinInt64
+	oe.notTags = map[string]bool{"Metric": true, "Value": true}
+	for _, f := range []string{oe.config.DedupeWindowField, oe.config.TimestampsField,
+		oe.config.RawTagsField, oe.config.TimestampField, oe.config.MetricSuffixField,
+		oe.config.PositionalTagsField} {
+		if f != "" {
+			oe.notTags[f] = true
+		}
+	}
+	for f := range oe.config.ValueFieldMetricMap {
+		oe.notTags[f] = true
+	}
+	if oe.config.SumCount || oe.config.Histogram {
+		oe.notTags[oe.config.SumField] = true
+		oe.notTags[oe.config.CountField] = true
+	}
+	if oe.config.Histogram {
+		oe.notTags[oe.config.HistogramBoundsField] = true
+		oe.notTags[oe.config.HistogramCountsField] = true
+	}
+
+	if oe.config.ValueExpr != "" {
+		// already parsed once by validate, so this can't fail
+		oe.valueExpr, _ = parseExpr(oe.config.ValueExpr)
+		// the Fields the value is computed from aren't tags
+		for _, f := range exprFields(oe.valueExpr) {
+			oe.notTags[f] = true
+		}
+	}
+	// any sources not listed keep their default order, after those listed
+	var precedence []string
+	precedence = append(precedence, oe.config.SourcePrecedence...)
+	precedence = append(precedence, defaultSourcePrecedence...)
+	seen := make(map[string]bool)
+	for _, source := range precedence {
+		if !seen[source] {
+			seen[source] = true
+			oe.tagSources = append([]string{source}, oe.tagSources...)
+		}
+	}
+
+	if oe.config.LoggerTagPattern != "" {
+		oe.loggerTags = regexp.MustCompile(oe.config.LoggerTagPattern)
+	}
+	if oe.config.DebugComments {
+		log.Printf("OpenTsdbRawEncoder: debug_comments is set, output is not valid for OpenTSDB")
+	}
+	if oe.config.HumanReadable {
+		log.Printf("OpenTsdbRawEncoder: human_readable is set, output is not valid for OpenTSDB")
+	}
+	if oe.config.FixedBaseTimestamp != 0 {
+		log.Printf("OpenTsdbRawEncoder: fixed_base_timestamp is set, timestamps are rebased for testing")
+	}
+	if oe.nowFunc == nil {
+		oe.nowFunc = time.Now
+	}
 	// We need to split a value from the key somehow, default to '.'
 	if oe.config.TagNamePrefix != "" && oe.config.TagValuePrefix == "" {
 		oe.config.TagValuePrefix = "."
 	}
 
+	// OpenTSDB 1.x has a fixed limit of 8 tags, and only allows ASCII names
+	// 2.x makes the limit configurable, and allows any Unicode letter
+	switch oe.config.OpenTsdbVersion {
+	case "":
+	case "1":
+		if oe.config.MaxTags == 0 {
+			oe.config.MaxTags = 8
+		}
+	case "2":
+		oe.config.Normalize.unicode = true
+	}
+
 	if len(oe.config.AddTagsIfMissing) > 0 {
 		for _, t := range oe.config.AddTagsIfMissing {
 			kv := strings.SplitN(t, "=", 2)
@@ -89,77 +554,711 @@ func (oe *OpenTsdbRawEncoder) Init(config interface{}) (err error) {
 		}
 	}
 
+	if oe.config.PlaceholderTag != "" {
+		oe.placeholderTag = strings.SplitN(oe.config.PlaceholderTag, "=", 2)
+	}
+
+	if oe.config.InstanceTag != "" {
+		id := make([]byte, 4)
+		if _, err = rand.Read(id); err != nil {
+			return fmt.Errorf("can't generate instance id: %s", err)
+		}
+		oe.overrideTags[oe.config.InstanceTag] = hex.EncodeToString(id)
+		log.Printf("OpenTsdbRawEncoder: tagging datapoints with %s=%s, every restart creates new series",
+			oe.config.InstanceTag, oe.overrideTags[oe.config.InstanceTag])
+	}
+
+	for _, t := range oe.config.AllowedTypes {
+		oe.allowedTypes[t] = true
+	}
+	for _, m := range oe.config.MaxTagsExempt {
+		oe.tagsExempt[m] = true
+	}
+
+	if oe.config.DropHostTag {
+		delete(oe.missingTags, "host")
+		delete(oe.overrideTags, "host")
+	} else if oe.config.AddHostnameIfMissing {
+		if _, ok := oe.missingTags["host"]; !ok {
+			var hostname string
+			if hostname, err = os.Hostname(); err != nil {
+				return fmt.Errorf("can't determine hostname: %s", err)
+			}
+			if oe.config.HostnameFqdn {
+				fqdn, lookupErr := lookupFqdn(hostname)
+				if lookupErr != nil {
+					log.Printf("OpenTsdbRawEncoder: can't resolve FQDN for '%s', using short name: %s",
+						hostname, lookupErr)
+				} else {
+					hostname = fqdn
+				}
+			}
+			oe.missingTags["host"] = hostname
+		}
+	}
+
+	if oe.config.InputRateInterval > 0 && !oe.config.DropHostTag {
+		host, ok := oe.overrideTags["host"]
+		if !ok {
+			host, ok = oe.missingTags["host"]
+		}
+		if !ok {
+			if host, err = os.Hostname(); err != nil {
+				return fmt.Errorf("can't determine hostname: %s", err)
+			}
+		}
+		oe.inputTags = " host=" + host
+	} else if oe.config.InputRateInterval > 0 {
+		// without a host, fall back on the placeholder (OpenTSDB needs a tag)
+		oe.inputTags = " " + oe.placeholderTag[0] + "=" + oe.placeholderTag[1]
+	}
+
 	return
 }
 
+// lookupFqdn resolves a hostname to its canonical name, trying a CNAME lookup
+// first and falling back to a reverse lookup of its addresses.  It's a
+// variable so tests can replace the resolver.
+var lookupFqdn = func(hostname string) (string, error) {
+	if cname, err := net.LookupCNAME(hostname); err == nil && cname != "" {
+		return strings.TrimSuffix(cname, "."), nil
+	}
+	addrs, err := net.LookupHost(hostname)
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if names, err := net.LookupAddr(addr); err == nil && len(names) > 0 {
+			return strings.TrimSuffix(names[0], "."), nil
+		}
+	}
+	return "", fmt.Errorf("no names found for %v", addrs)
+}
+
 func (oe *OpenTsdbRawEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err error) {
+	output, err = oe.encode(pack)
+	if err != nil {
+		atomic.AddInt64(&oe.errorCount, 1)
+	} else if len(output) > 0 {
+		atomic.AddInt64(&oe.encodedCount, 1)
+	}
+	if oe.config.InputRateInterval > 0 {
+		oe.inputRate()
+		// Heka discards the output of a failed message, so keep the rate
+		// datapoints until one succeeds
+		if err == nil {
+			output = append(output, oe.inputPending...)
+			oe.inputPending = nil
+		}
+	}
+	if len(output) > 0 && oe.config.DebugComments {
+		output = append([]byte("# uuid="+pack.Message.GetUuidString()+"\n"), output...)
+	}
+	if err != nil && oe.config.ErrorLogInterval > 0 {
+		err = oe.limitError(err)
+	}
+	return
+}
 
-	buf := new(bytes.Buffer)
+// loggedError tracks when an error was last returned, and how many identical
+// errors have been suppressed since.
+type loggedError struct {
+	at         time.Time
+	suppressed int
+}
 
-	metric, ok := pack.Message.GetFieldValue("Metric")
-	if !ok {
-		err = fmt.Errorf("Unable to find Field[Metric] in message")
-		return nil, err
+// maxLoggedErrors bounds the number of distinct errors being rate-limited.
+const maxLoggedErrors = 1000
+
+// limitError returns an error at most once per ErrorLogInterval (Heka logs
+// each error Encode returns), suppressing any identical ones in between.
+// The first error returned after a suppression reports how many were hidden.
+func (oe *OpenTsdbRawEncoder) limitError(err error) error {
+	now := oe.nowFunc()
+	interval := time.Duration(oe.config.ErrorLogInterval) * time.Second
+	key := err.Error()
+
+	if logged, ok := oe.errorLog[key]; ok {
+		if now.Sub(logged.at) < interval {
+			logged.suppressed++
+			return nil
+		}
+		delete(oe.errorLog, key)
+		if logged.suppressed > 0 {
+			err = fmt.Errorf("%s (%d identical errors suppressed)", err, logged.suppressed)
+		}
 	}
 
-	buf.WriteString("put ")
+	// forget about errors which haven't happened recently
+	if len(oe.errorLog) >= maxLoggedErrors {
+		for k, logged := range oe.errorLog {
+			if now.Sub(logged.at) >= interval {
+				delete(oe.errorLog, k)
+			}
+		}
+	}
+	if len(oe.errorLog) < maxLoggedErrors {
+		oe.errorLog[key] = &loggedError{at: now}
+	}
+	return err
+}
+
+// errSkipped is returned internally when a message is deliberately not
+// encoded, and is never returned by Encode.
+var errSkipped = errors.New("skipped")
+
+// metricValue is a value to emit, the metric name to emit it under, and any
+// (pre-formatted) tags specific to the value.
+type metricValue struct {
+	name  string
+	value interface{}
+	tags  string
+	ts    time.Time // if set, the only timestamp to emit the value at
+}
+
+func (oe *OpenTsdbRawEncoder) encode(pack *pipeline.PipelinePack) (output []byte, err error) {
+	if output, err = oe.encodeMessage(pack); err == errSkipped {
+		return nil, nil
+	}
+	return
+}
+
+func (oe *OpenTsdbRawEncoder) encodeMessage(pack *pipeline.PipelinePack) (output []byte, err error) {
 
-	var tags []string
-	// if we're looking for dynamic field data embedded in the metric name...
-	if oe.config.TagNamePrefix != "" {
-		metric_parts := strings.Split(metric.(string), oe.config.TagNamePrefix)
-		// write the metric name stripped of embedded tags
-		buf.WriteString(metric_parts[0])
-		// everything else will be embedded tag data
-		tags = metric_parts[1:]
+	if len(oe.allowedTypes) > 0 && !oe.allowedTypes[pack.Message.GetType()] {
+		return nil, errSkipped
+	}
+
+	var values []metricValue
+	var embedded []string
+	var multi bool
+	if len(oe.config.ValueFieldMetricMap) > 0 {
+		// values are mapped from Fields to metrics
+		if values, err = oe.mappedValues(pack.Message); err != nil {
+			return nil, err
+		}
 	} else {
-		// just use the whole metric name
-		buf.WriteString(fmt.Sprint(metric))
+		metric, ok := pack.Message.GetFieldValue("Metric")
+		if !ok {
+			err = fmt.Errorf("Unable to find Field[Metric] in message")
+			return nil, err
+		}
+
+		var name string
+		// if we're looking for dynamic field data embedded in the metric name...
+		if oe.config.TagNamePrefix != "" {
+			metric_parts := strings.Split(metric.(string), oe.config.TagNamePrefix)
+			// use the metric name stripped of embedded tags
+			name = metric_parts[0]
+			// everything else will be embedded tag data
+			embedded = metric_parts[1:]
+		} else {
+			// just use the whole metric name
+			var ok bool
+			if name, ok = metric.(string); !ok {
+				name = fmt.Sprint(metric)
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("empty metric name in '%s'", metric)
+		}
+
+		if oe.config.Histogram {
+			if values, err = oe.histogramValues(pack.Message, name); err != nil {
+				return nil, err
+			}
+		} else if oe.config.SumCount {
+			// a pair of metrics, so OpenTSDB can compute the average
+			sum, err := numericField(pack.Message, oe.config.SumField)
+			if err != nil {
+				return nil, err
+			}
+			count, err := numericField(pack.Message, oe.config.CountField)
+			if err != nil {
+				return nil, err
+			}
+			values = []metricValue{{name: name + ".sum", value: sum}, {name: name + ".count", value: count}}
+		} else if oe.config.ConstantValue != nil {
+			// the same value for every message (ie; counting events)
+			values = []metricValue{{name: name, value: *oe.config.ConstantValue}}
+		} else if oe.config.SeverityAsValue {
+			values = []metricValue{{name: name, value: int64(pack.Message.GetSeverity())}}
+		} else if field := pack.Message.FindFirstField("Value"); oe.config.MultiValue && field != nil {
+			// a batch of samples, one datapoint per element
+			for _, value := range multiValues(field) {
+				values = append(values, metricValue{name: name, value: value})
+			}
+			if len(values) == 0 {
+				return nil, fmt.Errorf("Field[Value] is empty")
+			}
+			multi = len(values) > 1
+		} else {
+			value, err := oe.messageValue(pack.Message)
+			if err != nil {
+				return nil, err
+			}
+			values = []metricValue{{name: name, value: value}}
+		}
 	}
-	buf.WriteString(" ")
 
 	// timestamp
 	var timestamp time.Time
 	if oe.config.TsFromMessage {
 		timestamp = time.Unix(0, pack.Message.GetTimestamp()).UTC()
 	} else {
-		timestamp = time.Now()
+		timestamp = oe.nowFunc()
+	}
+	if oe.config.TimestampField != "" {
+		if ts, ok := pack.Message.GetFieldValue(oe.config.TimestampField); ok {
+			switch ts := ts.(type) {
+			case int64:
+				timestamp = unixTimestamp(ts)
+			case float64:
+				if ts < 1e11 {
+					// keep any fractional seconds
+					timestamp = time.Unix(0, int64(ts*1e9)).UTC()
+				} else {
+					timestamp = unixTimestamp(int64(ts))
+				}
+			}
+		}
+	}
+	if oe.config.TimestampEpochOffset != 0 {
+		timestamp = timestamp.Add(time.Duration(oe.config.TimestampEpochOffset) * time.Second)
+	}
+	timestamps := []time.Time{timestamp}
+	if oe.config.TimestampsField != "" {
+		if field := pack.Message.FindFirstField(oe.config.TimestampsField); field != nil {
+			if timestamps, err = oe.backfillTimestamps(field); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if oe.config.FixedBaseTimestamp != 0 {
+		for i := range timestamps {
+			timestamps[i] = oe.rebase(timestamps[i])
+		}
+	}
+
+	// spread the elements of a multi-valued Value over their own timestamps
+	if multi {
+		if len(timestamps) == len(values) && oe.config.TimestampsField != "" {
+			for i := range values {
+				values[i].ts = timestamps[i]
+			}
+		} else if oe.config.ValueSpread > 0 {
+			last := timestamps[len(timestamps)-1]
+			step := time.Duration(oe.config.ValueSpread) * time.Second / time.Duration(len(values)-1)
+			for i := range values {
+				values[i].ts = last.Add(-time.Duration(len(values)-1-i) * step)
+			}
+		} else {
+			return nil, fmt.Errorf("Field[Value] has %d values, but no %d timestamps (see timestamps_field and value_spread)",
+				len(values), len(values))
+		}
+	}
+
+	// a suffix for the metric names (ie; the environment)
+	var suffix string
+	if oe.config.MetricSuffixField != "" {
+		if s, ok := pack.Message.GetFieldValue(oe.config.MetricSuffixField); ok {
+			if s := strings.Trim(strings.Map(sanitizeRune, fmt.Sprint(s)), "."); s != "" {
+				suffix = "." + s
+			}
+		}
+	}
+
+	// drop any skipped values, but not the others from the same message
+	var kept []metricValue
+	for _, v := range values {
+		if v.name, err = oe.checkName(v.name + suffix); err == nil {
+			v.value, err = oe.prepareValue(v.value)
+		}
+		if err == errSkipped {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		kept = append(kept, v)
+	}
+	if values = kept; len(values) == 0 {
+		return nil, errSkipped
 	}
-	buf.WriteString(fmt.Sprint(timestamp.Unix()))
-	buf.WriteString(" ")
 
-	// value
-	value, ok := pack.Message.GetFieldValue("Value")
+	var names []string
+	for _, v := range values {
+		names = append(names, v.name)
+	}
+	tagKeys, tagMap, err := oe.messageTags(pack.Message, strings.Join(names, ", "), embedded)
+	if err != nil {
+		return nil, err
+	}
+
+	// dedupe window, optionally overridden per message
+	window := oe.config.DedupeFlush
+	if oe.config.DedupeWindowField != "" {
+		if w, ok := pack.Message.GetFieldValue(oe.config.DedupeWindowField); ok {
+			switch w := w.(type) {
+			case int64:
+				window = w
+			case float64:
+				window = int64(w)
+			}
+		}
+	}
+
+	// any pre-formatted tags are appended as they are
+	var rawTags string
+	if oe.config.RawTagsField != "" {
+		if raw, ok := pack.Message.GetFieldValue(oe.config.RawTagsField); ok {
+			if !oe.config.DropHostTag {
+				if raw := strings.TrimSpace(fmt.Sprint(raw)); raw != "" {
+					rawTags = " " + raw
+				}
+			} else {
+				for _, tag := range strings.Fields(fmt.Sprint(raw)) {
+					if !strings.HasPrefix(tag, "host=") {
+						rawTags += " " + tag
+					}
+				}
+			}
+		}
+	}
+	// OpenTSDB requires at least one tag
+	if len(tagKeys) == 0 && rawTags == "" {
+		if oe.placeholderTag != nil {
+			tagKeys = []string{oe.placeholderTag[0]}
+			tagMap[oe.placeholderTag[0]] = oe.placeholderTag[1]
+		} else if oe.config.RequireTags {
+			return nil, fmt.Errorf("metric '%s' has no tags", strings.Join(names, ", "))
+		}
+	}
+	tags := formatTags(tagKeys, tagMap) + rawTags
+
+	// a rolled-up copy of each series, without the host tag
+	var hostlessTags string
+	_, hostless := tagMap["host"]
+	if hostless = hostless && oe.config.EmitHostless; hostless {
+		var keys []string
+		for _, k := range tagKeys {
+			if k != "host" {
+				keys = append(keys, k)
+			}
+		}
+		hostlessTags = formatTags(keys, tagMap) + rawTags
+	}
+
+	for _, v := range values {
+		if oe.config.MaxTags > 0 && len(tagKeys) > oe.config.MaxTags && !oe.tagsExempt[v.name] {
+			return nil, fmt.Errorf("metric '%s' has %d tags, more than max_tags (%d)",
+				v.name, len(tagKeys), oe.config.MaxTags)
+		}
+	}
+
+	// limit the cardinality of each tag name (a datapoint which later
+	// collides is for a series already seen, so its values are already known)
+	if oe.config.MaxValuesPerTagKey > 0 {
+		if err = oe.limitTagValues(strings.Join(names, ", "), tagKeys, tagMap); err != nil {
+			return nil, err
+		}
+	}
+
+	emitAt := func(p point, timestamps []time.Time) error {
+		for _, p.ts = range timestamps {
+			q, ok, err := oe.collide(p)
+			if err != nil {
+				return err
+			}
+			if ok {
+				output = append(output, oe.emitBucketed(q)...)
+			}
+		}
+		return nil
+	}
+
+	counted := make(map[string]bool)
+	for _, v := range values {
+		p := point{name: v.name, value: v.value, tags: oe.joinTags(tags, v.tags), window: window}
+		at := timestamps
+		if !v.ts.IsZero() {
+			at = []time.Time{v.ts}
+		}
+		kept := at
+		if oe.config.EmitThreshold != nil {
+			kept = nil
+			for _, ts := range at {
+				if oe.crossed(p.name+p.tags, p.value) {
+					kept = append(kept, ts)
+				}
+			}
+		}
+		if err = emitAt(p, kept); err != nil {
+			return nil, err
+		}
+		if hostless {
+			p.name = v.name + oe.config.HostlessSuffix
+			p.tags = oe.joinTags(hostlessTags, v.tags)
+			if err = emitAt(p, kept); err != nil {
+				return nil, err
+			}
+		}
+		if oe.config.EmitTagCount && !counted[v.name] {
+			counted[v.name] = true
+			count := point{
+				name:   oe.config.TagCountMetric,
+				value:  len(tagKeys) + len(strings.Fields(rawTags+v.tags)),
+				tags:   " metric=" + v.name,
+				window: window,
+			}
+			if err = emitAt(count, at); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return output, nil
+}
+
+// histogramValues reads a histogram from the HistogramBoundsField and
+// HistogramCountsField Fields, as a '.bucket' metric per bucket (with an 'le'
+// tag of its upper bound), plus '.sum' and '.count' metrics if the SumField
+// and CountField Fields are present.  A count beyond the last bound is the
+// "inf" bucket.
+func (oe *OpenTsdbRawEncoder) histogramValues(msg *message.Message, name string) (values []metricValue, err error) {
+	boundsField := msg.FindFirstField(oe.config.HistogramBoundsField)
+	countsField := msg.FindFirstField(oe.config.HistogramCountsField)
+	if boundsField == nil || countsField == nil {
+		return nil, fmt.Errorf("Unable to find Field[%s] and Field[%s] in message",
+			oe.config.HistogramBoundsField, oe.config.HistogramCountsField)
+	}
+
+	var bounds []float64
+	switch boundsField.GetValueType() {
+	case message.Field_DOUBLE:
+		bounds = boundsField.GetValueDouble()
+	case message.Field_INTEGER:
+		for _, b := range boundsField.GetValueInteger() {
+			bounds = append(bounds, float64(b))
+		}
+	default:
+		return nil, fmt.Errorf("Field[%s] is not numeric", oe.config.HistogramBoundsField)
+	}
+	var counts []interface{}
+	switch countsField.GetValueType() {
+	case message.Field_INTEGER:
+		for _, c := range countsField.GetValueInteger() {
+			counts = append(counts, c)
+		}
+	case message.Field_DOUBLE:
+		for _, c := range countsField.GetValueDouble() {
+			counts = append(counts, c)
+		}
+	default:
+		return nil, fmt.Errorf("Field[%s] is not numeric", oe.config.HistogramCountsField)
+	}
+	if len(counts) != len(bounds) && len(counts) != len(bounds)+1 {
+		return nil, fmt.Errorf("histogram has %d bounds but %d counts", len(bounds), len(counts))
+	}
+
+	for i, count := range counts {
+		le := "inf"
+		if i < len(bounds) {
+			le = strconv.FormatFloat(bounds[i], 'f', -1, 64)
+		}
+		values = append(values, metricValue{name: name + ".bucket", value: count, tags: " le=" + le})
+	}
+	if sum, err := numericField(msg, oe.config.SumField); err == nil {
+		values = append(values, metricValue{name: name + ".sum", value: sum})
+	}
+	if count, err := numericField(msg, oe.config.CountField); err == nil {
+		values = append(values, metricValue{name: name + ".count", value: count})
+	}
+	return
+}
+
+// mappedValues reads the values of each Field in ValueFieldMetricMap, in
+// sorted order of the Field names.  Any Fields missing from the message are
+// skipped, but at least one must be present.
+func (oe *OpenTsdbRawEncoder) mappedValues(msg *message.Message) (values []metricValue, err error) {
+	var fields []string
+	for f := range oe.config.ValueFieldMetricMap {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+
+	for _, f := range fields {
+		if value, ok := msg.GetFieldValue(f); ok {
+			name := oe.config.ValueFieldMetricPrefix + oe.config.ValueFieldMetricMap[f]
+			values = append(values, metricValue{name: name, value: value})
+		}
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("Unable to find any mapped value Fields (%s) in message",
+			strings.Join(fields, ", "))
+	}
+	return
+}
+
+// checkName normalizes a metric name and enforces MaxMetricNameBytes.
+func (oe *OpenTsdbRawEncoder) checkName(name string) (string, error) {
+	if oe.config.TrimMetricName {
+		name = strings.TrimSpace(name)
+	}
+	if oe.config.CollapseMetricSpaces {
+		name = collapseSpaces(name)
+	}
+	if name = oe.config.Normalize.name(name); name == "" {
+		return "", fmt.Errorf("empty metric name")
+	}
+	if oe.config.MaxMetricNameBytes > 0 && len(name) > oe.config.MaxMetricNameBytes {
+		if oe.config.MetricNameAction == "drop" {
+			log.Printf("OpenTsdbRawEncoder: dropping metric, name exceeds %d bytes: '%s'",
+				oe.config.MaxMetricNameBytes, name)
+			return "", errSkipped
+		}
+		log.Printf("OpenTsdbRawEncoder: truncating metric name to %d bytes: '%s'",
+			oe.config.MaxMetricNameBytes, name)
+		name = truncate(name, oe.config.MaxMetricNameBytes)
+	}
+	return name, nil
+}
+
+// messageValue finds the value of a message, from ValueExpr, ValueJsonPath
+// or Field[Value].
+func (oe *OpenTsdbRawEncoder) messageValue(msg *message.Message) (value interface{}, err error) {
+	if oe.valueExpr != nil {
+		v, err := oe.valueExpr.eval(func(name string) (float64, error) {
+			return numericField(msg, name)
+		})
+		if err == errDivideByZero {
+			if oe.config.ValueExprDivZero == "skip" {
+				return nil, errSkipped
+			}
+			v = oe.config.ValueExprDefault
+		} else if err != nil {
+			return nil, fmt.Errorf("can't evaluate value_expr: %s", err)
+		}
+		return v, nil
+	}
+	if oe.config.ValueJsonPath != "" {
+		return jsonPathValue(msg.GetPayload(), oe.config.ValueJsonPath)
+	}
+	value, ok := msg.GetFieldValue("Value")
 	if !ok {
 		err = fmt.Errorf("Unable to find Field[Value] field in message")
 		return nil, err
 	}
-	buf.WriteString(fmt.Sprint(value))
+	return value, nil
+}
 
-	// tags
-	tagMap := make(map[string]interface{})
-	var tagKeys []string
-	// start with any tags that were embedded in the metric name
-	for _, tag := range tags {
-		kv := strings.SplitN(tag, oe.config.TagValuePrefix, 2)
-		if len(kv) == 2 && kv[0] != "" && kv[1] != "" {
-			tagMap[kv[0]] = kv[1]
-			tagKeys = append(tagKeys, kv[0])
+// prepareValue converts and validates a value before it's emitted.
+func (oe *OpenTsdbRawEncoder) prepareValue(value interface{}) (interface{}, error) {
+	if b, isBool := value.(bool); isBool && oe.config.BoolAsInt {
+		if b {
+			value = 1
+		} else {
+			value = 0
+		}
+	}
+	if str, isString := value.(string); isString && oe.config.DecimalComma {
+		value = strings.Replace(str, ",", ".", -1)
+	}
+	if err := checkValue(value); err != nil {
+		return nil, err
+	}
+	if oe.config.ValueRound != nil {
+		value = roundValue(value, *oe.config.ValueRound)
+	}
+	if oe.config.MinValue != nil || oe.config.MaxValue != nil {
+		if f, ok := toFloat(value); ok {
+			var bound *float64
+			if oe.config.MinValue != nil && f < *oe.config.MinValue {
+				bound = oe.config.MinValue
+			} else if oe.config.MaxValue != nil && f > *oe.config.MaxValue {
+				bound = oe.config.MaxValue
+			}
+			if bound != nil {
+				if oe.config.RangeAction == "drop" {
+					return nil, errSkipped
+				}
+				value = *bound
+			}
 		}
 	}
+	return value, nil
+}
 
-	// add any tags from dynamic Message fields that have the TagNamePrefix
-	if oe.config.FieldsToTags {
-		fields := pack.Message.GetFields()
-		for _, field := range fields {
-			k := field.GetName()
-			if strings.HasPrefix(k, oe.config.TagNamePrefix) {
-				if k == "Metric" || k == "Value" {
-					continue
+// messageTags resolves the tags of a message, from any embedded tag data and
+// the various other sources, returning the tag names (in order) and values.
+func (oe *OpenTsdbRawEncoder) messageTags(msg *message.Message, name string, embedded []string) (
+	tagKeys []string, tagMap map[string]interface{}, err error) {
+
+	tagMap = make(map[string]interface{})
+	tagKeys = make([]string, 0, len(embedded)+len(msg.GetFields())+len(oe.missingTags)+len(oe.overrideTags))
+	set := func(k string, v interface{}) {
+		if _, ok := tagMap[k]; !ok {
+			tagKeys = append(tagKeys, k)
+		}
+		tagMap[k] = v
+	}
+
+	// add the tags from each source, lowest precedence first so the
+	// higher ones win
+	for _, source := range oe.tagSources {
+		switch source {
+		case "embedded":
+			// tags that were embedded in the metric name
+			for _, tag := range embedded {
+				kv := strings.SplitN(tag, oe.config.TagValuePrefix, 2)
+				if len(kv) == 2 && kv[0] != "" && (kv[1] != "" || !oe.config.StrictEmbeddedTags) {
+					set(kv[0], kv[1])
+				} else if oe.config.StrictEmbeddedTags {
+					metric, _ := msg.GetFieldValue("Metric")
+					return nil, nil, fmt.Errorf("malformed embedded tag '%s' in metric '%s'", tag, metric)
+				}
+			}
+
+		case "fields":
+			// tags from dynamic Message fields that have the TagNamePrefix
+			if oe.config.FieldsToTags {
+				for _, field := range msg.GetFields() {
+					k := field.GetName()
+					if strings.HasPrefix(k, oe.config.TagNamePrefix) && !oe.notTags[k] {
+						v := field.GetValue()
+						// an empty Field flags the presence of the tag
+						if oe.config.PresenceTagValue != "" && fmt.Sprint(v) == "" {
+							v = oe.config.PresenceTagValue
+						}
+						set(strings.TrimLeft(k, oe.config.TagNamePrefix), v)
+					}
+				}
+			}
+			// tags packed positionally into a single Field
+			if oe.config.PositionalTagsField != "" {
+				if packed, ok := msg.GetFieldValue(oe.config.PositionalTagsField); ok {
+					vals := strings.Split(fmt.Sprint(packed), oe.config.PositionalTagsDelimiter)
+					if len(vals) != len(oe.config.PositionalTagKeys) && oe.config.PositionalTagsStrict {
+						return nil, nil, fmt.Errorf("Field[%s] has %d values, expected %d: '%s'",
+							oe.config.PositionalTagsField, len(vals), len(oe.config.PositionalTagKeys), packed)
+					}
+					for i, k := range oe.config.PositionalTagKeys {
+						if i < len(vals) {
+							set(k, vals[i])
+						}
+					}
+				}
+			}
+
+		case "logger":
+			// tags captured from the Logger
+			if oe.loggerTags != nil {
+				if m := oe.loggerTags.FindStringSubmatch(msg.GetLogger()); m != nil {
+					for i, k := range oe.loggerTags.SubexpNames() {
+						if k != "" && m[i] != "" {
+							set(k, m[i])
+						}
+					}
 				}
-				k = strings.TrimLeft(k, oe.config.TagNamePrefix)
-				tagMap[k] = field.GetValue()
-				tagKeys = append(tagKeys, k)
 			}
 		}
 	}
@@ -172,6 +1271,14 @@ func (oe *OpenTsdbRawEncoder) Encode(pack *pipeline.PipelinePack) (output []byte
 		}
 	}
 
+	// add the message Severity, unless the tag is already set
+	if k := oe.config.SeverityTag; k != "" {
+		if _, ok := tagMap[k]; !ok {
+			tagKeys = append(tagKeys, k)
+			tagMap[k] = int64(msg.GetSeverity())
+		}
+	}
+
 	// override any tags unconditionally
 	for k, v := range oe.overrideTags {
 		if _, ok := tagMap[k]; !ok {
@@ -180,44 +1287,723 @@ func (oe *OpenTsdbRawEncoder) Encode(pack *pipeline.PipelinePack) (output []byte
 		tagMap[k] = v
 	}
 
-	// build the final tag string
-	tagString := new(bytes.Buffer)
+	// translate any mapped tag values
+	for k, m := range oe.config.TagValueMap {
+		if v, ok := tagMap[k]; ok {
+			if to, ok := m[fmt.Sprint(v)]; ok {
+				tagMap[k] = to
+			}
+		}
+	}
+
+	// OpenTSDB rejects empty tag values, so drop or replace them
+	nonEmpty := tagKeys[:0]
 	for _, k := range tagKeys {
-		tagString.WriteString(fmt.Sprintf(" %s=%v", k, tagMap[k]))
+		// only a string can format as empty
+		if s, ok := tagMap[k].(string); ok && s == "" {
+			if oe.config.DropEmptyTags {
+				delete(tagMap, k)
+				continue
+			}
+			tagMap[k] = oe.config.EmptyTagValue
+		}
+		nonEmpty = append(nonEmpty, k)
+	}
+	tagKeys = nonEmpty
+
+	// normalize tag names and values, merging any that now collide
+	if oe.config.Normalize.Lowercase || oe.config.Normalize.Sanitize ||
+		oe.config.Normalize.Transliterate || oe.config.TagKeyDotReplacement != "" {
+		normMap := make(map[string]interface{})
+		var normKeys []string
+		for _, k := range tagKeys {
+			v := tagMap[k]
+			if str, ok := v.(string); ok {
+				v = oe.config.Normalize.value(str)
+			}
+			k = oe.config.Normalize.name(k)
+			if oe.config.TagKeyDotReplacement != "" {
+				k = strings.Replace(k, ".", oe.config.TagKeyDotReplacement, -1)
+			}
+			if _, ok := normMap[k]; !ok {
+				normKeys = append(normKeys, k)
+			}
+			normMap[k] = v
+		}
+		tagMap, tagKeys = normMap, normKeys
+	}
+
+	// drop the host tag, for aggregated metrics
+	if _, ok := tagMap["host"]; ok && oe.config.DropHostTag {
+		delete(tagMap, "host")
+		var keptKeys []string
+		for _, k := range tagKeys {
+			if k != "host" {
+				keptKeys = append(keptKeys, k)
+			}
+		}
+		tagKeys = keptKeys
+	}
+
+	// enforce the maximum tag value length
+	if oe.config.MaxTagValueBytes > 0 {
+		var keptKeys []string
+		for _, k := range tagKeys {
+			v := fmt.Sprint(tagMap[k])
+			if len(v) > oe.config.MaxTagValueBytes {
+				if oe.config.TagValueAction == "drop" {
+					log.Printf("OpenTsdbRawEncoder: dropping tag '%s' of metric '%s', value exceeds %d bytes",
+						k, name, oe.config.MaxTagValueBytes)
+					delete(tagMap, k)
+					continue
+				}
+				log.Printf("OpenTsdbRawEncoder: truncating value of tag '%s' of metric '%s' to %d bytes",
+					k, name, oe.config.MaxTagValueBytes)
+				tagMap[k] = truncate(v, oe.config.MaxTagValueBytes)
+			}
+			keptKeys = append(keptKeys, k)
+		}
+		tagKeys = keptKeys
+	}
+
+	return
+}
+
+// limitTagValues drops a datapoint with a new value for a tag name which
+// already has MaxValuesPerTagKey values, otherwise recording its new values.
+// It must only be called once the datapoint has passed every other check, so
+// rejected datapoints don't use up the budget.
+func (oe *OpenTsdbRawEncoder) limitTagValues(name string, tagKeys []string, tagMap map[string]interface{}) error {
+	var newKeys []string
+	for _, k := range tagKeys {
+		v := fmt.Sprint(tagMap[k])
+		if oe.tagValues[k][v] {
+			continue
+		}
+		if len(oe.tagValues[k]) >= oe.config.MaxValuesPerTagKey {
+			log.Printf("OpenTsdbRawEncoder: dropping metric '%s', tag '%s' already has %d values: '%s'",
+				name, k, oe.config.MaxValuesPerTagKey, v)
+			return errSkipped
+		}
+		newKeys = append(newKeys, k)
+	}
+	for _, k := range newKeys {
+		if oe.tagValues[k] == nil {
+			oe.tagValues[k] = make(map[string]bool)
+		}
+		oe.tagValues[k][fmt.Sprint(tagMap[k])] = true
+	}
+	return nil
+}
+
+// backfillTimestamps reads the list of timestamps (in seconds) a datapoint
+// should be emitted at.
+func (oe *OpenTsdbRawEncoder) backfillTimestamps(field *message.Field) (timestamps []time.Time, err error) {
+	var seconds []int64
+	switch field.GetValueType() {
+	case message.Field_INTEGER:
+		seconds = field.GetValueInteger()
+	case message.Field_DOUBLE:
+		for _, d := range field.GetValueDouble() {
+			seconds = append(seconds, int64(d))
+		}
+	default:
+		return nil, fmt.Errorf("Field[%s] is not numeric", oe.config.TimestampsField)
+	}
+	if len(seconds) == 0 {
+		return nil, fmt.Errorf("Field[%s] is empty", oe.config.TimestampsField)
+	}
+
+	offset := time.Duration(oe.config.TimestampEpochOffset) * time.Second
+	for _, sec := range seconds {
+		timestamps = append(timestamps, time.Unix(sec, 0).UTC().Add(offset))
+	}
+	return
+}
+
+// rebase moves a timestamp onto FixedBaseTimestamp, keeping its offset from
+// the first timestamp seen, so recorded output is reproducible.
+func (oe *OpenTsdbRawEncoder) rebase(ts time.Time) time.Time {
+	if oe.firstSeen.IsZero() {
+		oe.firstSeen = ts
+	}
+	return time.Unix(oe.config.FixedBaseTimestamp, 0).UTC().Add(ts.Sub(oe.firstSeen))
+}
+
+// unixTimestamp converts a Unix timestamp in seconds, milliseconds,
+// microseconds or nanoseconds, detecting the unit from its magnitude.
+func unixTimestamp(n int64) time.Time {
+	switch {
+	case n < 1e11:
+		return time.Unix(n, 0).UTC()
+	case n < 1e14:
+		return time.Unix(0, n*1e6).UTC()
+	case n < 1e17:
+		return time.Unix(0, n*1e3).UTC()
+	}
+	return time.Unix(0, n).UTC()
+}
+
+// multiValues returns each of the values of a Field.
+func multiValues(field *message.Field) (values []interface{}) {
+	switch field.GetValueType() {
+	case message.Field_INTEGER:
+		for _, v := range field.GetValueInteger() {
+			values = append(values, v)
+		}
+	case message.Field_DOUBLE:
+		for _, v := range field.GetValueDouble() {
+			values = append(values, v)
+		}
+	default:
+		values = append(values, field.GetValue())
+	}
+	return
+}
+
+// roundValue rounds a float value (half away from zero) to the given number
+// of decimal places, leaving integers untouched.
+func roundValue(value interface{}, places int) interface{} {
+	var f float64
+	switch v := value.(type) {
+	case float64:
+		f = v
+	case string, json.Number:
+		// only strings which aren't integers
+		s := fmt.Sprint(v)
+		if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return value
+		}
+		var err error
+		if f, err = strconv.ParseFloat(s, 64); err != nil {
+			return value
+		}
+	default:
+		return value
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return f
+	}
+	p := math.Pow(10, float64(places))
+	if f < 0 {
+		return -math.Floor(-f*p+0.5) / p
+	}
+	return math.Floor(f*p+0.5) / p
+}
+
+// numericField returns the value of a numeric message Field.
+func numericField(msg *message.Message, name string) (float64, error) {
+	v, ok := msg.GetFieldValue(name)
+	if !ok {
+		return 0, fmt.Errorf("Unable to find Field[%s] in message", name)
+	}
+	switch v := v.(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return 0, fmt.Errorf("Field[%s] is not numeric", name)
+}
+
+// toFloat converts a (checked) value to a float64, if it's numeric.
+func toFloat(value interface{}) (f float64, ok bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// checkValue ensures a value can be written as an OpenTSDB value, rather
+// than emitting the string form of an arbitrary Go type.  String values must
+// be plain decimal numbers, which are emitted as they are.
+func checkValue(value interface{}) error {
+	switch v := value.(type) {
+	case int, int64, float64, json.Number:
+		return nil
+	case string:
+		// ParseFloat also accepts hex, underscores, NaN and Inf
+		if f, err := strconv.ParseFloat(v, 64); err != nil || math.IsNaN(f) || math.IsInf(f, 0) ||
+			strings.ContainsAny(v, "xX_") {
+			return fmt.Errorf("non-numeric value: '%s'", v)
+		}
+		return nil
+	case bool:
+		return fmt.Errorf("unsupported boolean value: %v (see bool_as_int)", value)
+	}
+	return fmt.Errorf("unsupported value type: %T", value)
+}
+
+// point is a single datapoint resolved from a message.
+type point struct {
+	name   string
+	ts     time.Time
+	value  interface{}
+	tags   string
+	window int64
+}
+
+// tagBuffers recycles the buffers used to build tag strings.
+var tagBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// formatTags builds the tag section of a line, in the order of keys.
+func formatTags(keys []string, tags map[string]interface{}) string {
+	buf := tagBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	var scratch [32]byte
+	for _, k := range keys {
+		buf.WriteByte(' ')
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.Write(appendValue(scratch[:0], tags[k]))
+	}
+	tagString := buf.String()
+	tagBuffers.Put(buf)
+	return tagString
+}
+
+// joinTags appends the tags of a value to those of its message, sorting them
+// by name if CanonicalTagOrder is set.
+func (oe *OpenTsdbRawEncoder) joinTags(tags, valueTags string) string {
+	tags += valueTags
+	if !oe.config.CanonicalTagOrder {
+		return tags
+	}
+	// sort on the tag name, then the whole tag
+	var keys []string
+	for _, tag := range strings.Fields(tags) {
+		keys = append(keys, strings.SplitN(tag, "=", 2)[0]+"\x00"+tag)
+	}
+	sort.Strings(keys)
+	buf := tagBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	for _, k := range keys {
+		buf.WriteByte(' ')
+		buf.WriteString(k[strings.IndexByte(k, 0)+1:])
 	}
+	tagString := buf.String()
+	tagBuffers.Put(buf)
+	return tagString
+}
+
+// appendValue appends the string form of a value to b, as fmt.Sprint would.
+func appendValue(b []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case string:
+		return append(b, v...)
+	case int64:
+		return strconv.AppendInt(b, v, 10)
+	case int:
+		return strconv.AppendInt(b, int64(v), 10)
+	case float64:
+		return strconv.AppendFloat(b, v, 'g', -1, 64)
+	case json.Number:
+		return append(b, v...)
+	case bool:
+		return strconv.AppendBool(b, v)
+	}
+	return append(b, fmt.Sprint(value)...)
+}
 
-	buf.Write(tagString.Bytes())
-	buf.WriteString("\n")
+// emit formats a datapoint as a 'put' line and runs it through the dedupe
+// buffer, returning whatever should be sent (which may be nothing, or the
+// previously withheld datapoint followed by this one).
+func (oe *OpenTsdbRawEncoder) emit(p point) []byte {
+
+	line := oe.formatLine(p.name, p.ts.Unix(), p.value, p.tags)
 
 	// dedupe
 	var previous []byte
-	if oe.config.DedupeFlush > 0 {
-		bufkey := fmt.Sprintf("%s:%s", metric, tagString)
+	if p.window > 0 {
+		bufkey := p.name + p.tags
+		last, seen := oe.dedupeBuffer[bufkey]
+
+		// The window runs from the last datapoint sent for the series and
+		// excludes its end: a repeated value is withheld while it's less than
+		// 'window' seconds later, one exactly 'window' seconds later is sent.
+		inWindow := p.ts.UnixNano()-last.ts < p.window*1e9
+		// nothing is withheld until the series has warmed up
+		warm := p.ts.UnixNano()-last.first >= oe.config.DedupeWarmup*1e9
+
+		// if we've already seen the value, add it to the buffer
+		if seen && oe.duplicate(last.val, p.value) && inWindow && warm {
+			last.last = p.ts.Unix()
+			last.skipped = true
+			oe.dedupeBuffer[bufkey] = last
+			atomic.AddInt64(&oe.skippedCount, 1)
+			return nil
+		}
+
+		// if the value's changed (or the window has passed) and we've withheld
+		// datapoints, return the last of them along with the current one
+		if seen && last.skipped {
+			previous = oe.formatLine(p.name, last.last, last.val, p.tags)
+		}
+
+		// track the last data point
+		first := p.ts.UnixNano()
+		if seen {
+			first = last.first
+		}
+		oe.dedupeBuffer[bufkey] = dedupe{split: len(p.name), val: p.value, ts: p.ts.UnixNano(), first: first}
+		if !seen {
+			atomic.StoreInt64(&oe.bufferedCount, int64(len(oe.dedupeBuffer)))
+		}
+	}
+
+	return append(previous, line...)
+}
+
+// crossed reports whether a series' value has just crossed EmitThreshold in
+// the configured direction.  Once crossed, a series must cross back over
+// EmitThresholdReset (or EmitThreshold itself) to cross again.
+func (oe *OpenTsdbRawEncoder) crossed(series string, value interface{}) bool {
+	v, ok := toFloat(value)
+	if !ok {
+		return false
+	}
+	threshold, reset := *oe.config.EmitThreshold, *oe.config.EmitThreshold
+	if oe.config.EmitThresholdReset != nil {
+		reset = *oe.config.EmitThresholdReset
+	}
+	if oe.config.EmitThresholdDirection == "below" {
+		// mirror the values and thresholds, to only compare one way
+		v, threshold, reset = -v, -threshold, -reset
+	}
 
-		if _, ok := oe.dedupeBuffer[bufkey]; ok {
+	if oe.crossedSeries[series] {
+		if v <= reset {
+			delete(oe.crossedSeries, series)
+		}
+		return false
+	}
+	if v > threshold {
+		oe.crossedSeries[series] = true
+		return true
+	}
+	return false
+}
 
-			// if we've already seen the value, add it to the buffer
-			if oe.dedupeBuffer[bufkey].val == value &&
-				(timestamp.UnixNano()-oe.dedupeBuffer[bufkey].ts < oe.config.DedupeFlush*1e9) {
+// collide resolves a datapoint with the same timestamp as, but a different
+// value to, the last sent (or withheld, and yet to be sent) for its series
+// (which OpenTSDB would overwrite), with the TimestampCollisionAction.  It
+// returns the datapoint to emit, and whether to emit it at all.  Collisions
+// are only detected with dedupe.
+func (oe *OpenTsdbRawEncoder) collide(p point) (point, bool, error) {
+	if p.window <= 0 || oe.config.TimestampCollisionAction == "last" {
+		return p, true, nil
+	}
+	key := p.name + p.tags
+	last, seen := oe.dedupeBuffer[key]
+	ts := last.ts / 1e9
+	if last.skipped {
+		ts = last.last
+	}
+	if !seen || ts != p.ts.Unix() || last.val == p.value {
+		return p, true, nil
+	}
 
-				oe.dedupeBuffer[bufkey] = dedupe{data: buf.Bytes(), skipped: true, val: value, ts: oe.dedupeBuffer[bufkey].ts}
-				return nil, nil
+	switch oe.config.TimestampCollisionAction {
+	case "first":
+		return p, false, nil
+	case "sum":
+		l, lok := toFloat(last.val)
+		v, vok := toFloat(p.value)
+		if lok && vok {
+			// the sum replaces any withheld datapoint, rather than following it
+			if last.skipped {
+				last.skipped = false
+				oe.dedupeBuffer[key] = last
 			}
+			p.value = l + v
+			return p, true, nil
+		}
+	}
+	return p, false, fmt.Errorf("metric '%s' has different values (%v and %v) at timestamp %d",
+		p.name, last.val, p.value, p.ts.Unix())
+}
 
-			// if the value's changed, and we've skipped it before (or it's been > the flush interval)
-			// return the stored data point, and the current one
-			if (oe.dedupeBuffer[bufkey].skipped ||
-				(oe.dedupeBuffer[bufkey].skipped && timestamp.UnixNano()-oe.dedupeBuffer[bufkey].ts >= oe.config.DedupeFlush*1e9)) &&
-				oe.dedupeBuffer[bufkey].val != value {
+// inputRate counts a message received, queueing a datapoint of the average
+// input rate (messages/sec) at the end of each InputRateInterval once a
+// message arrives after it.  A run of intervals with no messages is
+// reported as zeros, at the first and last of them (so the series is zero
+// throughout, rather than interpolated).
+func (oe *OpenTsdbRawEncoder) inputRate() {
+	now := oe.nowFunc()
+	if oe.inputStart.IsZero() {
+		oe.inputStart = now
+	}
+	interval := time.Duration(oe.config.InputRateInterval) * time.Second
+	queue := func(n int64, rate float64) {
+		ts := oe.inputStart.Add(time.Duration(n) * interval).Unix()
+		oe.inputPending = append(oe.inputPending,
+			oe.formatLine(oe.config.InputRateMetric, ts, rate, oe.inputTags)...)
+	}
+	if ended := int64(now.Sub(oe.inputStart) / interval); ended > 0 {
+		queue(1, float64(oe.inputCount)/interval.Seconds())
+		if ended > 1 {
+			queue(2, 0)
+		}
+		if ended > 2 {
+			queue(ended, 0)
+		}
+		oe.inputStart, oe.inputCount = oe.inputStart.Add(time.Duration(ended)*interval), 0
+	}
+	oe.inputCount++
+}
 
-				previous = oe.dedupeBuffer[bufkey].data
+// ReportMsg implements pipeline.ReportingPlugin, reporting the number of
+// messages encoded, datapoints withheld by dedupe, errors and series tracked
+// for dedupe.
+func (oe *OpenTsdbRawEncoder) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "EncodedMessages", atomic.LoadInt64(&oe.encodedCount), "count")
+	message.NewInt64Field(msg, "DedupeSkipped", atomic.LoadInt64(&oe.skippedCount), "count")
+	message.NewInt64Field(msg, "EncodeErrors", atomic.LoadInt64(&oe.errorCount), "count")
+	message.NewInt64Field(msg, "DedupeBufferSize", atomic.LoadInt64(&oe.bufferedCount), "count")
+	return nil
+}
+
+// duplicate reports whether value repeats the last value sent for a series,
+// and so can be withheld.
+func (oe *OpenTsdbRawEncoder) duplicate(last, value interface{}) bool {
+	l, lok := toFloat(last)
+	v, vok := toFloat(value)
+	numeric := lok && vok
+	if oe.config.DedupeEmitOnDecrease && numeric && v < l {
+		return false
+	}
+	if oe.config.DedupePercentTolerance > 0 && numeric {
+		// there's no relative change from zero, so only zero repeats it
+		if l == 0 {
+			return v == 0
+		}
+		return math.Abs(v-l)/math.Abs(l)*100 <= oe.config.DedupePercentTolerance
+	}
+	return last == value
+}
+
+// emitBucketed collapses all the datapoints of a series within each
+// DedupeBucket into the last of them, withholding it until a datapoint (of
+// any series) for a later bucket arrives, or Flush is called.  Datapoints
+// arriving after their bucket has ended are emitted as they are.
+func (oe *OpenTsdbRawEncoder) emitBucketed(p point) (output []byte) {
+	if oe.config.DedupeBucket <= 0 {
+		return oe.emit(p)
+	}
+	bucket := p.ts.Unix() / oe.config.DedupeBucket
+	if bucket > oe.bucket {
+		oe.bucket = bucket
+		output = oe.releaseBuckets()
+	} else if bucket < oe.bucket {
+		return oe.emit(p)
+	}
+	oe.buckets[p.name+p.tags] = p
+	return
+}
+
+// releaseBuckets emits the datapoints held for the current DedupeBucket of
+// each series, in sorted order.
+func (oe *OpenTsdbRawEncoder) releaseBuckets() (output []byte) {
+	var keys []string
+	for k := range oe.buckets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		output = append(output, oe.emit(oe.buckets[k])...)
+	}
+	if len(keys) > 0 {
+		oe.buckets = make(map[string]point)
+	}
+	return
+}
+
+// formatLine builds a single line, in the configured format.
+func (oe *OpenTsdbRawEncoder) formatLine(name string, ts int64, value interface{}, tags string) []byte {
+	if oe.config.HumanReadable {
+		return formatHumanLine(name, ts, value, tags)
+	}
+	if oe.config.NdJson {
+		return formatJsonLine(name, ts, value, tags)
+	}
+	return formatPutLine(name, ts, value, tags, oe.config.ValuePosition == "after_tags")
+}
+
+// jsonPoint is a datapoint in OpenTSDB's JSON form, for NDJSON output.
+type jsonPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     interface{}       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// formatJsonLine builds a single line holding a JSON object, with the value
+// as a JSON number.  Datapoints which can't be represented (ie; NaN values)
+// are logged and dropped.
+func formatJsonLine(name string, ts int64, value interface{}, tags string) []byte {
+	if str, ok := value.(string); ok {
+		if f, err := strconv.ParseFloat(str, 64); err == nil {
+			value = f
+		}
+	}
+	p := jsonPoint{Metric: name, Timestamp: ts, Value: value, Tags: make(map[string]string)}
+	for _, tag := range strings.Fields(tags) {
+		if kv := strings.SplitN(tag, "=", 2); len(kv) == 2 {
+			p.Tags[kv[0]] = kv[1]
+		}
+	}
+	line, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("OpenTsdbRawEncoder: dropping metric '%s', can't encode as JSON: %s", name, err)
+		return nil
+	}
+	return append(line, '\n')
+}
+
+// formatHumanLine builds a single line of tab-separated columns (metric,
+// time, value and tags), for debugging.
+func formatHumanLine(name string, ts int64, value interface{}, tags string) []byte {
+	line := make([]byte, 0, len(name)+len(tags)+40)
+	line = append(line, name...)
+	line = append(line, '\t')
+	line = append(line, time.Unix(ts, 0).UTC().Format(time.RFC3339)...)
+	line = append(line, '\t')
+	line = appendValue(line, value)
+	line = append(line, '\t')
+	line = append(line, strings.TrimPrefix(tags, " ")...)
+	return append(line, '\n')
+}
+
+// formatPutLine builds a single 'put' line, optionally with the value after
+// the tags (for legacy consumers).
+func formatPutLine(name string, ts int64, value interface{}, tags string, valueLast bool) []byte {
+	line := make([]byte, 0, len(name)+len(tags)+40)
+	line = append(line, "put "...)
+	line = append(line, name...)
+	line = append(line, ' ')
+	line = strconv.AppendInt(line, ts, 10)
+	if valueLast {
+		line = append(line, tags...)
+		line = append(line, ' ')
+		line = appendValue(line, value)
+	} else {
+		line = append(line, ' ')
+		line = appendValue(line, value)
+		line = append(line, tags...)
+	}
+	return append(line, '\n')
+}
+
+// Flush returns any datapoints currently withheld by the dedupe buffer (or
+// held for the current DedupeBucket), so the last seen value of each series
+// isn't lost (eg; on shutdown).
+// Datapoints are grouped by metric name, with the metrics (and the series
+// within each metric) in sorted order.  Heka doesn't call this itself, and it
+// must not be called concurrently with Encode.
+func (oe *OpenTsdbRawEncoder) Flush() (output []byte) {
+	// release the datapoints held for the current bucket of each series
+	// first, so they're deduped as normal
+	output = oe.releaseBuckets()
+
+	// sort on metric name first, then the full series key
+	var keys []string
+	series := make(map[string]string)
+	for k, d := range oe.dedupeBuffer {
+		if d.skipped {
+			sortKey := k[:d.split] + "\x00" + k
+			series[sortKey] = k
+			keys = append(keys, sortKey)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, sortKey := range keys {
+		k := series[sortKey]
+		d := oe.dedupeBuffer[k]
+		output = append(output, oe.formatLine(k[:d.split], d.last, d.val, k[d.split:])...)
+		d.skipped = false
+		oe.dedupeBuffer[k] = d
+	}
+	return
+}
+
+// EncodeAll runs the encoder over a slice of messages (in order), followed by
+// a Flush of the dedupe buffer, and returns the resulting lines without their
+// trailing newlines.  It's intended to make testing of whole streams easier,
+// and stops at the first message that fails to encode.
+func (oe *OpenTsdbRawEncoder) EncodeAll(msgs []*message.Message) (lines []string, err error) {
+	var output []byte
+	for i, msg := range msgs {
+		out, err := oe.Encode(&pipeline.PipelinePack{Message: msg})
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %s", i, err)
+		}
+		output = append(output, out...)
+	}
+	output = append(output, oe.Flush()...)
+
+	for _, line := range strings.Split(string(output), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return
+}
+
+// EncodeBatch runs the encoder over a batch of packs (in order), returning the
+// combined output of all those that encoded, and an error for each that
+// didn't (identifying it by its index in the batch), so one bad message
+// doesn't stop the rest.
+func (oe *OpenTsdbRawEncoder) EncodeBatch(packs []*pipeline.PipelinePack) (output []byte, errs []error) {
+	for i, pack := range packs {
+		out, err := oe.Encode(pack)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("message %d: %s", i, err))
+			continue
+		}
+		output = append(output, out...)
+	}
+	return
+}
+
+// collapseSpaces replaces each run of whitespace in s with a single space.
+func collapseSpaces(s string) string {
+	var b bytes.Buffer
+	space := false
+	for _, r := range s {
+		if unicode.IsSpace(r) {
+			if !space {
+				b.WriteByte(' ')
 			}
+			space = true
+			continue
 		}
-		// track the last data point
-		oe.dedupeBuffer[bufkey] = dedupe{data: buf.Bytes(), val: value, ts: timestamp.UnixNano()}
+		b.WriteRune(r)
+		space = false
 	}
+	return b.String()
+}
 
-	return append(previous, buf.Bytes()...), nil
+// truncate shortens s to at most n bytes, without splitting a UTF-8 sequence.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
 }
 
 func init() {